@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"time"
 
@@ -13,6 +14,9 @@ import (
 )
 
 func main() {
+	timeout := flag.Duration("timeout", time.Second, "Deadline of the calls")
+	flag.Parse()
+
 	conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure(), grpc.WithBlock())
 	if err != nil {
 		log.Fatalf("could not connect: %v", err)
@@ -26,7 +30,7 @@ func main() {
 
 	client := greeterpb.NewGreeterClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 
 	ctx = metadata.AppendToOutgoingContext(ctx,
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 
+	"step-04_interceptors/internal/budget"
 	loggerpb "step-04_interceptors/internal/logger"
 
 	"google.golang.org/grpc"
@@ -20,6 +21,9 @@ type loggerServer struct {
 
 func (s *loggerServer) Log(ctx context.Context, req *loggerpb.LogRequest) (*loggerpb.LogReply, error) {
 	log.Printf("Received log message: %s", req.Message)
+	for _, hop := range budget.Hops(ctx) {
+		log.Printf("Deadline budget: %s", hop)
+	}
 	return &loggerpb.LogReply{
 		Ok: true,
 	}, nil
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
@@ -12,7 +13,9 @@ import (
 	"net"
 	"time"
 
+	"step-04_interceptors/internal/budget"
 	"step-04_interceptors/internal/greeter"
+	"step-04_interceptors/internal/healthcheck"
 	loggerpb "step-04_interceptors/internal/logger"
 )
 
@@ -92,22 +95,42 @@ func (s *greeterServer) UploadNames(stream greeterpb.Greeter_UploadNamesServer)
 }
 
 func main() {
+	reserve := flag.Duration("budget-reserve", budget.DefaultReserve, "Time kept for the Greeter after calling the Logger")
+	minimum := flag.Duration("budget-min", budget.DefaultMinimum, "Shortest deadline worth sending to the Logger; less fails fast")
+	defaultBudget := flag.Duration("budget-default", time.Second, "Budget of requests that arrive without a deadline")
+	flag.Parse()
+
 	lis, err := net.Listen("tcp", ":50051")
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
+	// Calls to the Logger get the remaining budget of the request minus a
+	// reserve for building the Greeter's own response
+	deadlines := budget.New(budget.Config{
+		Service: "greeter",
+		Reserve: *reserve,
+		Minimum: *minimum,
+		Default: *defaultBudget,
+	})
+
 	// Create gRPC server
 	grpcServer := grpc.NewServer(
 		grpc.ChainUnaryInterceptor(
 			loggingUnaryInterceptor,
+			deadlines.UnaryServerInterceptor(),
 		),
 		grpc.ChainStreamInterceptor(
 			loggingStreamInterceptor,
+			deadlines.StreamServerInterceptor(),
 		),
 	)
 
-	conn, err := grpc.Dial("localhost:50052", grpc.WithInsecure())
+	conn, err := grpc.Dial("localhost:50052",
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(deadlines.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(deadlines.StreamClientInterceptor()),
+	)
 	if err != nil {
 		log.Fatalf("❌ Could not connect to logger: %v", err)
 	}
@@ -121,8 +144,27 @@ func main() {
 	// Register health check service
 	healthServer := health.NewServer()
 
-	// This marks the Greeter service as healthy
-	healthServer.SetServingStatus("greeter.Greeter", healthpb.HealthCheckResponse_SERVING)
+	// The Greeter is only healthy while its dependencies are: the Logger
+	// connection must be up and there must be room for log storage.
+	healthManager := healthcheck.NewManager(healthServer)
+	healthManager.Register(healthcheck.Probe{
+		Name:     "logger-connection",
+		Check:    healthcheck.ConnReady(conn),
+		Services: []string{"greeter.Greeter"},
+		Interval: 5 * time.Second,
+		Timeout:  2 * time.Second,
+	})
+	healthManager.Register(healthcheck.Probe{
+		Name:             "log-storage-disk",
+		Check:            healthcheck.DiskSpace(".", 100<<20),
+		Services:         []string{"greeter.Greeter"},
+		Interval:         30 * time.Second,
+		FailureThreshold: 1,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go healthManager.Run(ctx)
 
 	// Register the health service with gRPC
 	healthpb.RegisterHealthServer(grpcServer, healthServer)
@@ -0,0 +1,229 @@
+// Package healthcheck drives the standard gRPC health service from probes
+// instead of a hard-coded SERVING status. Each probe runs periodically, and
+// the services it covers are marked NOT_SERVING after enough consecutive
+// failures. Status changes are pushed to Watch subscribers by the underlying
+// health.Server.
+package healthcheck
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Defaults applied to zero fields of a Probe.
+const (
+	DefaultInterval         = 5 * time.Second
+	DefaultTimeout          = time.Second
+	DefaultFailureThreshold = 3
+	DefaultSuccessThreshold = 1
+)
+
+// Check reports a problem by returning an error.
+type Check func(ctx context.Context) error
+
+// Probe describes one dependency check and the services it affects.
+type Probe struct {
+	Name  string
+	Check Check
+	// Services whose status depends on this probe. The overall server
+	// status ("") always depends on every probe.
+	Services []string
+
+	Interval time.Duration
+	Timeout  time.Duration
+	// FailureThreshold consecutive failures mark the probe unhealthy.
+	FailureThreshold int
+	// SuccessThreshold consecutive successes mark it healthy again.
+	SuccessThreshold int
+}
+
+type probeState struct {
+	Probe
+
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// Manager runs probes and keeps a health.Server up to date.
+type Manager struct {
+	server *health.Server
+
+	mu       sync.Mutex
+	probes   []*probeState
+	services map[string]struct{}
+	started  bool
+}
+
+// NewManager returns a manager updating server. Register the probes and
+// call Run before serving. Until the first round of probes completes, the
+// server reports NOT_SERVING.
+func NewManager(server *health.Server) *Manager {
+	server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return &Manager{
+		server:   server,
+		services: map[string]struct{}{"": {}},
+	}
+}
+
+// Register adds a probe. It must be called before Run.
+func (m *Manager) Register(p Probe) {
+	if p.Interval <= 0 {
+		p.Interval = DefaultInterval
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultTimeout
+	}
+	if p.FailureThreshold <= 0 {
+		p.FailureThreshold = DefaultFailureThreshold
+	}
+	if p.SuccessThreshold <= 0 {
+		p.SuccessThreshold = DefaultSuccessThreshold
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.started {
+		panic("healthcheck: Register called after Run")
+	}
+
+	m.probes = append(m.probes, &probeState{Probe: p})
+	for _, svc := range p.Services {
+		m.services[svc] = struct{}{}
+		m.server.SetServingStatus(svc, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// Run checks every probe once, publishes the result and keeps probing until
+// ctx is done. On return all services are marked NOT_SERVING.
+func (m *Manager) Run(ctx context.Context) {
+	m.mu.Lock()
+	m.started = true
+	probes := m.probes
+	m.mu.Unlock()
+
+	// First round synchronously, so the server starts with a real status
+	// rather than an optimistic SERVING.
+	for _, p := range probes {
+		m.runProbe(ctx, p, true)
+	}
+	m.publish()
+
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p *probeState) {
+			defer wg.Done()
+			m.loop(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+
+	// Tell Watch subscribers we are going away.
+	m.server.Shutdown()
+}
+
+// Status returns the current status of a service.
+func (m *Manager) Status(service string) healthpb.HealthCheckResponse_ServingStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.statusLocked(service)
+}
+
+func (m *Manager) loop(ctx context.Context, p *probeState) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if m.runProbe(ctx, p, false) {
+				m.publish()
+			}
+		}
+	}
+}
+
+// runProbe executes the check and applies the thresholds. It reports
+// whether the probe changed between healthy and unhealthy. The first run
+// decides the initial state directly.
+func (m *Manager) runProbe(ctx context.Context, p *probeState, first bool) bool {
+	checkCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	err := p.Check(checkCtx)
+	cancel()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	was := p.healthy
+	if err == nil {
+		p.successes++
+		p.failures = 0
+		if first || p.successes >= p.SuccessThreshold {
+			p.healthy = true
+		}
+	} else {
+		p.failures++
+		p.successes = 0
+		if first || p.failures >= p.FailureThreshold {
+			p.healthy = false
+		}
+	}
+
+	if first {
+		if err != nil {
+			log.Printf("❌ health probe %q failing: %v", p.Name, err)
+		}
+		return true
+	}
+	if was == p.healthy {
+		return false
+	}
+
+	if p.healthy {
+		log.Printf("✅ health probe %q recovered", p.Name)
+	} else {
+		log.Printf("❌ health probe %q failed %d times: %v", p.Name, p.failures, err)
+	}
+	return true
+}
+
+// publish pushes the aggregated status of every service to the health
+// server, which notifies Watch subscribers when a status changes.
+func (m *Manager) publish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for svc := range m.services {
+		m.server.SetServingStatus(svc, m.statusLocked(svc))
+	}
+}
+
+func (m *Manager) statusLocked(service string) healthpb.HealthCheckResponse_ServingStatus {
+	if _, ok := m.services[service]; !ok {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+
+	for _, p := range m.probes {
+		if !p.healthy && (service == "" || covers(p.Services, service)) {
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+func covers(services []string, service string) bool {
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
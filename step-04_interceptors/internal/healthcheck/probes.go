@@ -0,0 +1,47 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ConnReady checks that a client connection to a dependency is READY. An
+// idle connection is asked to connect, and the check waits for it until its
+// timeout expires.
+func ConnReady(conn *grpc.ClientConn) Check {
+	return func(ctx context.Context) error {
+		for {
+			state := conn.GetState()
+			switch state {
+			case connectivity.Ready:
+				return nil
+			case connectivity.Idle:
+				conn.Connect()
+			case connectivity.Shutdown:
+				return fmt.Errorf("connection to %s is shut down", conn.Target())
+			}
+
+			if !conn.WaitForStateChange(ctx, state) {
+				return fmt.Errorf("connection to %s is %s", conn.Target(), state)
+			}
+		}
+	}
+}
+
+// DiskSpace checks that the filesystem holding path has at least minFree
+// bytes available, e.g. for log storage.
+func DiskSpace(path string, minFree uint64) Check {
+	return func(ctx context.Context) error {
+		free, err := freeBytes(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", path, err)
+		}
+		if free < minFree {
+			return fmt.Errorf("only %d MiB free on %s, need %d MiB", free>>20, path, minFree>>20)
+		}
+		return nil
+	}
+}
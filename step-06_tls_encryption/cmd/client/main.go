@@ -3,50 +3,46 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
+	"step-06_tls_encryption/internal/certreload"
 	pb "step-06_tls_encryption/internal/greeter"
 )
 
 const (
 	defaultName = "world"
 	serverAddr  = "localhost:50051"
-	certFile    = "certs/server.crt" // Server's certificate that client will verify
+	certFile    = "certs/client.crt"
+	keyFile     = "certs/client.key"
+	caFile      = "certs/ca.crt" // CA that signed the server's certificate
 )
 
-func loadTLSCredentials() (credentials.TransportCredentials, error) {
-	// Load certificate of the CA who signed server's certificate
-	pemServerCA, err := ioutil.ReadFile("certs/ca.crt")
+// loadTLSCredentials loads the client's key pair and the CA used to verify
+// the server. Rotated files are picked up by the returned reloader.
+func loadTLSCredentials() (credentials.TransportCredentials, *certreload.Reloader, error) {
+	reloader, err := certreload.New(certreload.Config{
+		Name:     "client",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+		return nil, nil, fmt.Errorf("failed to load client credentials: %v", err)
 	}
 
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(pemServerCA) {
-		return nil, fmt.Errorf("failed to add server CA's certificate")
-	}
-
-	// Load client's certificate and private key
-	clientCert, err := tls.LoadX509KeyPair("certs/client.crt", "certs/client.key")
+	// The server certificate must be issued for the host we dial
+	host, _, err := net.SplitHostPort(serverAddr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load client key pair: %v", err)
-	}
-
-	// Create the credentials and return it
-	config := &tls.Config{
-		Certificates: []tls.Certificate{clientCert},
-		RootCAs:      certPool,
+		return nil, nil, fmt.Errorf("invalid server address %q: %v", serverAddr, err)
 	}
-
-	return credentials.NewTLS(config), nil
+	return credentials.NewTLS(reloader.ClientConfig(&tls.Config{ServerName: host})), reloader, nil
 }
 
 func main() {
@@ -55,11 +51,15 @@ func main() {
 	flag.Parse()
 
 	// Set up a connection to the server with TLS
-	creds, err := loadTLSCredentials()
+	creds, reloader, err := loadTLSCredentials()
 	if err != nil {
 		log.Fatalf("could not load TLS keys: %s", err)
 	}
 
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	go reloader.Watch(watchCtx)
+
 	// Set up a connection to the server with TLS
 	conn, err := grpc.Dial(serverAddr, grpc.WithTransportCredentials(creds))
 	if err != nil {
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"step-06_tls_encryption/internal/pki"
+)
+
+const usage = `labs-certs mints the certificates used by the TLS examples.
+
+Usage:
+  labs-certs <command> [flags]
+
+Commands:
+  init     create a CA plus a server and a client certificate
+  ca       create a new certificate authority
+  server   issue a server certificate with DNS/IP SANs
+  client   issue a client certificate with URI SANs
+  renew    re-issue certificates that are about to expire
+  revoke   add certificates to the CA's revocation list
+  crl      re-sign the revocation list with a fresh next-update time
+
+Run "labs-certs <command> -h" for the flags of a command.
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "init":
+		err = runInit(args)
+	case "ca":
+		err = runCA(args)
+	case "server":
+		err = runServer(args)
+	case "client":
+		err = runClient(args)
+	case "renew":
+		err = runRenew(args)
+	case "revoke":
+		err = runRevoke(args)
+	case "crl":
+		err = runCRL(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+}
+
+// runInit produces the same set of files as `make certs`.
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Output directory")
+	trustDomain := fs.String("trust-domain", "labs", "SPIFFE trust domain for the client certificate")
+	force := fs.Bool("force", false, "Overwrite existing certificates")
+	fs.Parse(args)
+
+	certFile, keyFile := caPaths(*dir)
+	if _, err := os.Stat(certFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to replace it", certFile)
+	}
+
+	ca, err := pki.NewAuthority("Test CA", pki.DefaultCAValidity)
+	if err != nil {
+		return err
+	}
+	if err := ca.Write(certFile, keyFile); err != nil {
+		return err
+	}
+	log.Printf("✅ CA written to %s", certFile)
+
+	server, err := ca.IssueServer(pki.Request{
+		CommonName:  "localhost",
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeIssued(*dir, "server", server); err != nil {
+		return err
+	}
+
+	id, err := pki.SPIFFEID(*trustDomain, "greeter-client")
+	if err != nil {
+		return err
+	}
+	client, err := ca.IssueClient(pki.Request{
+		CommonName: "client",
+		URIs:       []*url.URL{id},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeIssued(*dir, "client", client); err != nil {
+		return err
+	}
+
+	// An empty CRL, valid as long as the certificates above.
+	return writeCRL(*dir, ca, nil, big.NewInt(1), pki.DefaultLeafValidity)
+}
+
+func runCA(args []string) error {
+	fs := flag.NewFlagSet("ca", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Output directory")
+	cn := fs.String("cn", "Test CA", "Common name of the CA")
+	validity := fs.Duration("validity", pki.DefaultCAValidity, "How long the CA is valid")
+	force := fs.Bool("force", false, "Overwrite an existing CA")
+	fs.Parse(args)
+
+	certFile, keyFile := caPaths(*dir)
+	if _, err := os.Stat(certFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to replace it", certFile)
+	}
+
+	ca, err := pki.NewAuthority(*cn, *validity)
+	if err != nil {
+		return err
+	}
+	if err := ca.Write(certFile, keyFile); err != nil {
+		return err
+	}
+	log.Printf("✅ CA %q written to %s (expires %s)", *cn, certFile, ca.Cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory holding ca.crt/ca.key and the output files")
+	name := fs.String("name", "server", "Base name of the output files")
+	cn := fs.String("cn", "localhost", "Common name")
+	dns := fs.String("dns", "localhost", "Comma-separated DNS SANs")
+	ips := fs.String("ip", "127.0.0.1", "Comma-separated IP SANs")
+	validity := fs.Duration("validity", pki.DefaultLeafValidity, "How long the certificate is valid")
+	fs.Parse(args)
+
+	ca, err := pki.LoadAuthority(caPaths(*dir))
+	if err != nil {
+		return err
+	}
+
+	req := pki.Request{
+		CommonName: *cn,
+		DNSNames:   splitList(*dns),
+		Validity:   *validity,
+	}
+	for _, s := range splitList(*ips) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", s)
+		}
+		req.IPAddresses = append(req.IPAddresses, ip)
+	}
+
+	issued, err := ca.IssueServer(req)
+	if err != nil {
+		return err
+	}
+	return writeIssued(*dir, *name, issued)
+}
+
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory holding ca.crt/ca.key and the output files")
+	name := fs.String("name", "client", "Base name of the output files")
+	cn := fs.String("cn", "client", "Common name")
+	trustDomain := fs.String("trust-domain", "labs", "SPIFFE trust domain")
+	spiffePath := fs.String("spiffe-id", "greeter-client", "Workload path appended to spiffe://<trust-domain>/ (empty to skip)")
+	uris := fs.String("uri", "", "Additional comma-separated URI SANs")
+	dns := fs.String("dns", "", "Comma-separated DNS SANs")
+	validity := fs.Duration("validity", pki.DefaultLeafValidity, "How long the certificate is valid")
+	fs.Parse(args)
+
+	ca, err := pki.LoadAuthority(caPaths(*dir))
+	if err != nil {
+		return err
+	}
+
+	req := pki.Request{
+		CommonName: *cn,
+		DNSNames:   splitList(*dns),
+		Validity:   *validity,
+	}
+	if *spiffePath != "" {
+		id, err := pki.SPIFFEID(*trustDomain, *spiffePath)
+		if err != nil {
+			return err
+		}
+		req.URIs = append(req.URIs, id)
+	}
+	for _, s := range splitList(*uris) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid URI %q: %v", s, err)
+		}
+		req.URIs = append(req.URIs, u)
+	}
+
+	issued, err := ca.IssueClient(req)
+	if err != nil {
+		return err
+	}
+	return writeIssued(*dir, *name, issued)
+}
+
+func runRenew(args []string) error {
+	fs := flag.NewFlagSet("renew", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory holding ca.crt/ca.key and the certificates")
+	names := fs.String("names", "server,client", "Comma-separated base names of the certificates to check")
+	within := fs.Duration("within", 30*24*time.Hour, "Renew certificates expiring within this window")
+	validity := fs.Duration("validity", pki.DefaultLeafValidity, "Validity of renewed certificates")
+	force := fs.Bool("force", false, "Renew even if the certificate is not expiring")
+	fs.Parse(args)
+
+	ca, err := pki.LoadAuthority(caPaths(*dir))
+	if err != nil {
+		return err
+	}
+	if pki.NeedsRenewal(ca.Cert, *within) {
+		log.Printf("⚠️ CA expires %s, create a new one with `labs-certs ca -force`", ca.Cert.NotAfter.Format(time.RFC3339))
+	}
+
+	for _, name := range splitList(*names) {
+		certFile := filepath.Join(*dir, name+".crt")
+		cert, err := pki.LoadCertificate(certFile)
+		if err != nil {
+			return err
+		}
+
+		if !*force && !pki.NeedsRenewal(cert, *within) {
+			log.Printf("%s is valid until %s, skipping", certFile, cert.NotAfter.Format(time.RFC3339))
+			continue
+		}
+
+		issued, err := ca.Renew(cert, *validity)
+		if err != nil {
+			return err
+		}
+		if err := writeIssued(*dir, name, issued); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runRevoke(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory holding ca.crt/ca.key, ca.crl and the certificates")
+	names := fs.String("names", "client", "Comma-separated base names of the certificates to revoke")
+	nextUpdate := fs.Duration("next-update", 30*24*time.Hour, "How long the new CRL is considered fresh")
+	fs.Parse(args)
+
+	ca, err := pki.LoadAuthority(caPaths(*dir))
+	if err != nil {
+		return err
+	}
+
+	entries, number, err := currentCRL(*dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, name := range splitList(*names) {
+		cert, err := pki.LoadCertificate(filepath.Join(*dir, name+".crt"))
+		if err != nil {
+			return err
+		}
+		if isRevoked(entries, cert.SerialNumber) {
+			log.Printf("%s (serial %x) is already revoked", name, cert.SerialNumber)
+			continue
+		}
+
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: now,
+		})
+		log.Printf("🚫 revoking %s (%s, serial %x)", name, cert.Subject.CommonName, cert.SerialNumber)
+	}
+
+	return writeCRL(*dir, ca, entries, number.Add(number, big.NewInt(1)), *nextUpdate)
+}
+
+func runCRL(args []string) error {
+	fs := flag.NewFlagSet("crl", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory holding ca.crt/ca.key and ca.crl")
+	nextUpdate := fs.Duration("next-update", 30*24*time.Hour, "How long the new CRL is considered fresh")
+	fs.Parse(args)
+
+	ca, err := pki.LoadAuthority(caPaths(*dir))
+	if err != nil {
+		return err
+	}
+
+	entries, number, err := currentCRL(*dir)
+	if err != nil {
+		return err
+	}
+	return writeCRL(*dir, ca, entries, number.Add(number, big.NewInt(1)), *nextUpdate)
+}
+
+// currentCRL returns the entries and number of the existing CRL, or an
+// empty list when there is none yet.
+func currentCRL(dir string) ([]x509.RevocationListEntry, *big.Int, error) {
+	crlFile := filepath.Join(dir, "ca.crl")
+	if _, err := os.Stat(crlFile); os.IsNotExist(err) {
+		return nil, big.NewInt(0), nil
+	}
+
+	crl, err := pki.LoadCRL(crlFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	number := new(big.Int)
+	if crl.Number != nil {
+		number.Set(crl.Number)
+	}
+	return crl.RevokedCertificateEntries, number, nil
+}
+
+func isRevoked(entries []x509.RevocationListEntry, serial *big.Int) bool {
+	for _, e := range entries {
+		if e.SerialNumber.Cmp(serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCRL(dir string, ca *pki.Authority, entries []x509.RevocationListEntry, number *big.Int, nextUpdate time.Duration) error {
+	crl, err := ca.CreateCRL(entries, number, nextUpdate)
+	if err != nil {
+		return err
+	}
+
+	crlFile := filepath.Join(dir, "ca.crl")
+	if err := pki.WriteCRL(crlFile, crl); err != nil {
+		return err
+	}
+	log.Printf("✅ CRL #%s with %d entries written to %s (next update %s)",
+		crl.Number, len(entries), crlFile, crl.NextUpdate.Format(time.RFC3339))
+	return nil
+}
+
+func writeIssued(dir, name string, issued *pki.Issued) error {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := issued.Write(certFile, keyFile); err != nil {
+		return err
+	}
+	log.Printf("✅ %s written to %s (expires %s)", issued.Cert.Subject.CommonName, certFile, issued.Cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func caPaths(dir string) (string, string) {
+	return filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -3,26 +3,45 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 
+	"step-06_tls_encryption/internal/authz"
+	"step-06_tls_encryption/internal/certreload"
 	pb "step-06_tls_encryption/internal/greeter"
+	"step-06_tls_encryption/internal/revocation"
 )
 
 const (
-	port     = ":50051"
-	certFile = "certs/server.crt"
-	keyFile  = "certs/server.key"
-	caFile   = "certs/ca.crt"
+	port        = ":50051"
+	metricsAddr = ":9090"
+	certFile    = "certs/server.crt"
+	keyFile     = "certs/server.key"
+	caFile      = "certs/ca.crt"
 )
 
+// policy lists who may call which method. Identities come from the client
+// certificate (SPIFFE URI SAN, DNS SAN or CN) or from a bearer token.
+var policy = authz.Policy{
+	"/greeter.Greeter/SayHello": {"spiffe://labs/greeter-client", "token:admin"},
+}
+
+// tokens maps bearer tokens to the principal they authenticate as.
+var tokens = map[string]string{
+	"my-secret-token": "token:admin",
+}
+
 // server is used to implement greeter.GreeterServer
 type server struct {
 	pb.UnimplementedGreeterServer
@@ -30,45 +49,87 @@ type server struct {
 
 // SayHello implements greeter.GreeterServer
 func (s *server) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
-	log.Printf("Received: %v", in.GetName())
+	principal, _ := authz.FromContext(ctx)
+	log.Printf("Received: %v (caller %s via %s)", in.GetName(), principal.Name, principal.Source)
 	return &pb.HelloReply{Message: "Hello " + in.GetName()}, nil
 }
 
-func loadTLSCredentials() (credentials.TransportCredentials, error) {
-	// Load server's certificate and private key
-	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// loadTLSCredentials loads the server's key pair and the CA that signed the
+// client certificates. The returned reloader swaps in rotated files, so new
+// handshakes pick them up without a restart. Client certificates are checked
+// against the revocation lists during the handshake.
+func loadTLSCredentials(metrics *certreload.Metrics, checker *revocation.Checker) (credentials.TransportCredentials, *certreload.Reloader, error) {
+	reloader, err := certreload.New(certreload.Config{
+		Name:     "server",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+		Metrics:  metrics,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to load server key pair: %v", err)
+		return nil, nil, fmt.Errorf("failed to load server credentials: %v", err)
 	}
 
-	// Load certificate of the CA who signed client's certificate
-	pemClientCA, err := ioutil.ReadFile(caFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load client CA: %v", err)
+	base := &tls.Config{
+		VerifyPeerCertificate: checker.VerifyPeerCertificate,
 	}
+	return credentials.NewTLS(reloader.ServerConfig(base)), reloader, nil
+}
 
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(pemClientCA) {
-		return nil, fmt.Errorf("failed to add client CA's certificate")
-	}
+func main() {
+	crlFiles := flag.String("crl", "certs/ca.crl", "Comma-separated CRL files")
+	crlRefresh := flag.Duration("crl-refresh", time.Minute, "How often CRLs are reloaded")
+	crlStale := flag.String("crl-stale", "fail-closed", "What to do when a CRL is missing or stale: fail-closed or fail-open")
+	crlHandshake := flag.Bool("crl-reject-handshake", false, "Abort the TLS handshake for revoked certificates instead of failing their calls with Unauthenticated")
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Create the credentials and return it
-	config := &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    certPool,
+	// Load the certificate revocation lists
+	stale, err := revocation.ParseStalePolicy(*crlStale)
+	if err != nil {
+		log.Fatalf("invalid -crl-stale: %v", err)
+	}
+	checker, err := revocation.New(revocation.Config{
+		CRLFiles:   strings.Split(*crlFiles, ","),
+		CAFile:     caFile,
+		Interval:   *crlRefresh,
+		Stale:      stale,
+		DeferToRPC: !*crlHandshake,
+	})
+	if err != nil {
+		log.Fatalf("could not load CRLs: %v", err)
 	}
+	go checker.Watch(ctx)
 
-	return credentials.NewTLS(config), nil
-}
+	// Create a metrics registry for the certificate reload metrics
+	reg := prometheus.NewRegistry()
 
-func main() {
 	// Create the TLS credentials
-	creds, err := loadTLSCredentials()
+	creds, reloader, err := loadTLSCredentials(certreload.NewMetrics(reg), checker)
 	if err != nil {
 		log.Fatalf("could not load TLS keys: %s", err)
 	}
 
+	// Watch the certificate files for rotation
+	go reloader.Watch(ctx)
+
+	// Start metrics server in a separate goroutine
+	go func() {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		metricsServer := &http.Server{
+			Addr:    metricsAddr,
+			Handler: metricsMux,
+		}
+
+		log.Printf("Starting metrics server on http://localhost%s/metrics", metricsAddr)
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start metrics server: %v", err)
+		}
+	}()
+
 	// Create a listener on TCP port
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
@@ -76,7 +137,17 @@ func main() {
 	}
 
 	// Create an array of gRPC server options with the credentials
-	s := grpc.NewServer(grpc.Creds(creds))
+	s := grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(
+			checker.UnaryServerInterceptor(),
+			authz.UnaryServerInterceptor(policy, authz.PeerCertificate(), authz.BearerToken(tokens)),
+		),
+		grpc.ChainStreamInterceptor(
+			checker.StreamServerInterceptor(),
+			authz.StreamServerInterceptor(policy, authz.PeerCertificate(), authz.BearerToken(tokens)),
+		),
+	)
 
 	// Register the Greeter service on the server
 	pb.RegisterGreeterServer(s, &server{})
@@ -0,0 +1,209 @@
+// Package authz decides which callers may invoke which RPCs. Callers are
+// identified either by their verified mTLS client certificate or by a bearer
+// token, and both kinds of identity are checked against the same per-method
+// policy, e.g. "only spiffe://labs/logger-writer may call Logger.Log".
+package authz
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Identity sources.
+const (
+	SourceURI   = "uri"
+	SourceDNS   = "dns"
+	SourceCN    = "cn"
+	SourceToken = "token"
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Name is what policies match on, e.g. spiffe://labs/greeter-client.
+	Name string
+	// Source tells where Name came from.
+	Source string
+}
+
+// Authenticator extracts a principal from an incoming call. It returns
+// ok=false when the call carries no credentials of its kind, and an error
+// when it carries credentials that are invalid.
+type Authenticator func(ctx context.Context) (p Principal, ok bool, err error)
+
+// PeerCertificate identifies callers by their verified client certificate.
+// See IdentityFromCertificate for which name is used.
+func PeerCertificate() Authenticator {
+	return func(ctx context.Context) (Principal, bool, error) {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.AuthInfo == nil {
+			return Principal{}, false, nil
+		}
+
+		tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok {
+			return Principal{}, false, nil
+		}
+
+		// Only trust certificates the handshake verified against our CA.
+		chains := tlsInfo.State.VerifiedChains
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return Principal{}, false, nil
+		}
+
+		principal, ok := IdentityFromCertificate(chains[0][0])
+		if !ok {
+			return Principal{}, false, status.Error(codes.Unauthenticated, "client certificate carries no identity")
+		}
+		return principal, true, nil
+	}
+}
+
+// IdentityFromCertificate returns the principal a certificate represents:
+// its SPIFFE ID, the first spiffe:// URI SAN, wherever it is among the URI
+// SANs. Other URI SANs are not identities. Certificates without a SPIFFE
+// ID fall back to the first DNS SAN, then the CN.
+func IdentityFromCertificate(cert *x509.Certificate) (Principal, bool) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return Principal{Name: uri.String(), Source: SourceURI}, true
+		}
+	}
+	if len(cert.DNSNames) > 0 {
+		return Principal{Name: cert.DNSNames[0], Source: SourceDNS}, true
+	}
+	if cert.Subject.CommonName != "" {
+		return Principal{Name: cert.Subject.CommonName, Source: SourceCN}, true
+	}
+	return Principal{}, false
+}
+
+// BearerToken identifies callers by the "authorization: bearer <token>"
+// header. tokens maps each valid token to the principal name it stands for.
+func BearerToken(tokens map[string]string) Authenticator {
+	return func(ctx context.Context) (Principal, bool, error) {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return Principal{}, false, nil
+		}
+
+		authHeader := md.Get("authorization")
+		if len(authHeader) == 0 {
+			return Principal{}, false, nil
+		}
+
+		token, found := strings.CutPrefix(authHeader[0], "bearer ")
+		if !found {
+			return Principal{}, false, status.Error(codes.Unauthenticated, "authorization header must be a bearer token")
+		}
+
+		name, ok := tokens[token]
+		if !ok {
+			return Principal{}, false, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return Principal{Name: name, Source: SourceToken}, true, nil
+	}
+}
+
+// Policy maps full method names to the principals allowed to call them.
+// Keys are either exact ("/logger.Logger/Log") or a whole service
+// ("/logger.Logger/*"). The principal "*" allows any authenticated caller.
+// Methods not listed are denied.
+type Policy map[string][]string
+
+// Allowed reports whether principal may call fullMethod.
+func (p Policy) Allowed(fullMethod, principal string) bool {
+	allowed, ok := p[fullMethod]
+	if !ok {
+		if i := strings.LastIndex(fullMethod, "/"); i > 0 {
+			allowed, ok = p[fullMethod[:i]+"/*"]
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	for _, name := range allowed {
+		if name == "*" || name == principal {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// FromContext returns the principal the current call was allowed as.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// authorize runs every authenticator and allows the call if any of the
+// principals found is allowed. A call may present both a client certificate
+// and a token, e.g. an mTLS client acting for an admin, so stopping at the
+// first identity would make the others unusable. Invalid credentials fail
+// the call even if another identity would be allowed.
+func authorize(ctx context.Context, fullMethod string, policy Policy, authenticators []Authenticator) (context.Context, error) {
+	var principals []Principal
+	for _, authenticate := range authenticators {
+		principal, ok, err := authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			principals = append(principals, principal)
+		}
+	}
+
+	var denied []string
+	for _, principal := range principals {
+		if policy.Allowed(fullMethod, principal.Name) {
+			return context.WithValue(ctx, principalKey{}, principal), nil
+		}
+		denied = append(denied, principal.Name)
+	}
+	if len(denied) > 0 {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed to call %s", strings.Join(denied, ", "), fullMethod)
+	}
+	return nil, status.Error(codes.Unauthenticated, "no client certificate or token provided")
+}
+
+// UnaryServerInterceptor enforces policy on unary RPCs.
+func UnaryServerInterceptor(policy Policy, authenticators ...Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authorize(ctx, info.FullMethod, policy, authenticators)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor enforces policy on streaming RPCs.
+func StreamServerInterceptor(policy Policy, authenticators ...Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), info.FullMethod, policy, authenticators)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &principalStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// principalStream carries the authorized context into stream handlers.
+type principalStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *principalStream) Context() context.Context {
+	return s.ctx
+}
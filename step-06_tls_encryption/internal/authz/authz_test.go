@@ -0,0 +1,183 @@
+package authz_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"step-06_tls_encryption/internal/authz"
+	pb "step-06_tls_encryption/internal/greeter"
+	"step-06_tls_encryption/internal/pki"
+)
+
+const adminToken = "my-secret-token"
+
+type greeter struct {
+	pb.UnimplementedGreeterServer
+}
+
+// SayHello greets the principal the call was allowed as.
+func (greeter) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	p, _ := authz.FromContext(ctx)
+	return &pb.HelloReply{Message: p.Name}, nil
+}
+
+// startServer runs a greeter that requires client certificates and the
+// same policy as cmd/server, and returns its address.
+func startServer(t *testing.T, ca *pki.Authority) string {
+	t.Helper()
+	srvCert, err := ca.IssueServer(pki.Request{
+		CommonName:  "localhost",
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := authz.Policy{
+		"/greeter.Greeter/SayHello": {"spiffe://labs/greeter-client", "token:admin"},
+	}
+	tokens := map[string]string{adminToken: "token:admin"}
+
+	s := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{srvCert.TLSCertificate()},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.Pool(),
+			MinVersion:   tls.VersionTLS13,
+		})),
+		grpc.UnaryInterceptor(authz.UnaryServerInterceptor(policy, authz.PeerCertificate(), authz.BearerToken(tokens))),
+	)
+	pb.RegisterGreeterServer(s, greeter{})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+// dial connects to addr with a client certificate for the SPIFFE ID path.
+func dial(t *testing.T, ca *pki.Authority, addr, path string) pb.GreeterClient {
+	t.Helper()
+	id, err := pki.SPIFFEID("labs", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.IssueClient(pki.Request{CommonName: path, URIs: []*url.URL{id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert.TLSCertificate()},
+		RootCAs:      ca.Pool(),
+		MinVersion:   tls.VersionTLS13,
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewGreeterClient(conn)
+}
+
+func TestAuthorize(t *testing.T) {
+	ca, err := pki.NewAuthority("authz test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, ca)
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "allowed certificate", path: "greeter-client", want: "spiffe://labs/greeter-client"},
+		{name: "allowed certificate and token", path: "greeter-client", token: adminToken, want: "spiffe://labs/greeter-client"},
+		{name: "denied certificate and admin token", path: "intruder", token: adminToken, want: "token:admin"},
+		{name: "denied certificate", path: "intruder", wantCode: codes.PermissionDenied},
+		{name: "denied certificate and invalid token", path: "intruder", token: "guess", wantCode: codes.Unauthenticated},
+		{name: "allowed certificate and invalid token", path: "greeter-client", token: "guess", wantCode: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dial(t, ca, addr, tt.path)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "bearer "+tt.token)
+			}
+
+			r, err := client.SayHello(ctx, &pb.HelloRequest{Name: "test"})
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("SayHello() error = %v, want code %v", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SayHello() error = %v", err)
+			}
+			if r.GetMessage() != tt.want {
+				t.Errorf("SayHello() allowed as %q, want %q", r.GetMessage(), tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityFromCertificate(t *testing.T) {
+	ca, err := pki.NewAuthority("authz test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := pki.SPIFFEID("labs", "greeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := url.Parse("https://labs.example/greeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		req        pki.Request
+		want       string
+		wantSource string
+	}{
+		{name: "SPIFFE ID", req: pki.Request{CommonName: "client", URIs: []*url.URL{id}}, want: id.String(), wantSource: authz.SourceURI},
+		{name: "SPIFFE ID after another URI", req: pki.Request{CommonName: "client", URIs: []*url.URL{web, id}}, want: id.String(), wantSource: authz.SourceURI},
+		{name: "SPIFFE ID and DNS name", req: pki.Request{CommonName: "client", DNSNames: []string{"client.labs"}, URIs: []*url.URL{id}}, want: id.String(), wantSource: authz.SourceURI},
+		{name: "other URI and DNS name", req: pki.Request{CommonName: "client", DNSNames: []string{"client.labs"}, URIs: []*url.URL{web}}, want: "client.labs", wantSource: authz.SourceDNS},
+		{name: "other URI only", req: pki.Request{CommonName: "client", URIs: []*url.URL{web}}, want: "client", wantSource: authz.SourceCN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := ca.IssueClient(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := authz.IdentityFromCertificate(cert.Cert)
+			if !ok {
+				t.Fatal("IdentityFromCertificate() found no identity")
+			}
+			if p.Name != tt.want || p.Source != tt.wantSource {
+				t.Errorf("IdentityFromCertificate() = %s (%s), want %s (%s)", p.Name, p.Source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package certreload
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records reload outcomes and certificate expiry times.
+// A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	reloads     *prometheus.CounterVec
+	lastSuccess *prometheus.GaugeVec
+	expiry      *prometheus.GaugeVec
+}
+
+// NewMetrics creates the reload metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		reloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "tls_credentials_reloads_total",
+				Help: "Total number of TLS credential reloads by result.",
+			},
+			[]string{"name", "result"},
+		),
+		lastSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "tls_credentials_last_reload_success_timestamp_seconds",
+				Help: "Unix time of the last successful TLS credential reload.",
+			},
+			[]string{"name"},
+		),
+		expiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "tls_certificate_expiry_timestamp_seconds",
+				Help: "Unix time at which the loaded certificate expires. For CA bundles, the earliest expiry.",
+			},
+			[]string{"name", "file"},
+		),
+	}
+
+	reg.MustRegister(m.reloads, m.lastSuccess, m.expiry)
+	return m
+}
+
+func (m *Metrics) reloaded(name string) {
+	if m == nil {
+		return
+	}
+	m.reloads.WithLabelValues(name, "success").Inc()
+	m.lastSuccess.WithLabelValues(name).SetToCurrentTime()
+}
+
+func (m *Metrics) reloadFailed(name string) {
+	if m == nil {
+		return
+	}
+	m.reloads.WithLabelValues(name, "failure").Inc()
+}
+
+func (m *Metrics) setExpiry(name, file string, notAfter time.Time) {
+	if m == nil {
+		return
+	}
+	m.expiry.WithLabelValues(name, file).Set(float64(notAfter.Unix()))
+}
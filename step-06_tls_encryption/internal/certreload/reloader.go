@@ -0,0 +1,313 @@
+// Package certreload keeps TLS credentials in sync with the certificate, key
+// and CA files on disk. Rotated files are picked up by polling and swapped in
+// atomically, so new handshakes use them without restarting the process.
+// Connections that are already established keep their original certificates.
+package certreload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultInterval is how often the files are checked for changes.
+const DefaultInterval = 10 * time.Second
+
+// Config describes the files a Reloader watches.
+type Config struct {
+	// Name identifies the credentials in logs and metrics, e.g. "server".
+	Name     string
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CA certificates used to verify the peer.
+	CAFile string
+	// Interval between checks for changed files. Defaults to DefaultInterval.
+	Interval time.Duration
+	// Metrics is optional.
+	Metrics *Metrics
+}
+
+// Reloader holds the current key pair and CA pool.
+type Reloader struct {
+	cfg Config
+
+	cert atomic.Pointer[tls.Certificate]
+	pool atomic.Pointer[x509.CertPool]
+
+	mu    sync.Mutex
+	stamp map[string]fileStamp
+}
+
+// fileStamp is what we compare to decide whether a file changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// New loads the files once and fails if any of them is unusable.
+func New(cfg Config) (*Reloader, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Name == "" {
+		cfg.Name = "default"
+	}
+
+	r := &Reloader{cfg: cfg, stamp: make(map[string]fileStamp)}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads all files and swaps them in. On error the previous
+// credentials stay in place.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamps, err := r.stat()
+	if err != nil {
+		r.cfg.Metrics.reloadFailed(r.cfg.Name)
+		return err
+	}
+
+	if err := r.load(); err != nil {
+		r.cfg.Metrics.reloadFailed(r.cfg.Name)
+		return err
+	}
+
+	r.stamp = stamps
+	return nil
+}
+
+// Watch polls the files until ctx is done and reloads them when any of them
+// changed. Failures are logged and retried on the next tick.
+func (r *Reloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := r.changed()
+			if err != nil {
+				log.Printf("❌ %s credentials: %v", r.cfg.Name, err)
+				r.cfg.Metrics.reloadFailed(r.cfg.Name)
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			if err := r.Reload(); err != nil {
+				log.Printf("❌ failed to reload %s credentials, keeping the previous ones: %v", r.cfg.Name, err)
+				continue
+			}
+			leaf := r.cert.Load().Leaf
+			log.Printf("🔄 reloaded %s credentials (%s, expires %s)",
+				r.cfg.Name, leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+// Certificate returns the current key pair.
+func (r *Reloader) Certificate() *tls.Certificate {
+	return r.cert.Load()
+}
+
+// Pool returns the current CA pool.
+func (r *Reloader) Pool() *x509.CertPool {
+	return r.pool.Load()
+}
+
+// ServerConfig returns a config for a server that requires client
+// certificates. Every handshake gets a copy of base with the current key
+// pair and client CA pool, so base can carry extra settings such as
+// VerifyPeerCertificate. base may be nil.
+func (r *Reloader) ServerConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		base = &tls.Config{}
+	}
+
+	tmpl := base.Clone()
+	tmpl.ClientAuth = tls.RequireAndVerifyClientCert
+	if tmpl.MinVersion == 0 {
+		tmpl.MinVersion = tls.VersionTLS12
+	}
+	// The returned config replaces the one gRPC built, so it has to offer
+	// HTTP/2 itself or ALPN negotiation fails.
+	tmpl.NextProtos = appendH2(tmpl.NextProtos)
+
+	return &tls.Config{
+		MinVersion: tmpl.MinVersion,
+		NextProtos: tmpl.NextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := tmpl.Clone()
+			cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return r.cert.Load(), nil
+			}
+			cfg.ClientCAs = r.pool.Load()
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns a config for a client presenting the current key pair
+// and verifying the server against the current CA pool. base.ServerName is
+// the name, DNS or IP, the server certificate must match; handshakes fail
+// without one.
+func (r *Reloader) ClientConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		base = &tls.Config{}
+	}
+
+	cfg := base.Clone()
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return r.cert.Load(), nil
+	}
+
+	// RootCAs is read once per handshake and cannot be swapped, so the
+	// built-in verification is replaced by one against the current pool:
+	// chain to a trusted root and match base.ServerName. The name is not
+	// taken from the connection state, which has no name for IP targets.
+	cfg.InsecureSkipVerify = true
+	serverName := base.ServerName
+	verify := base.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := r.verifyServer(cs, serverName); err != nil {
+			return err
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+	return cfg
+}
+
+// verifyServer checks the server certificate. x509 matches serverName
+// against the IP SANs when it is an IP address, and the DNS SANs otherwise.
+func (r *Reloader) verifyServer(cs tls.ConnectionState, serverName string) error {
+	if serverName == "" {
+		return fmt.Errorf("no server name to verify the server certificate against")
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         r.pool.Load(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+func (r *Reloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %v", err)
+	}
+
+	caPEM, err := os.ReadFile(r.cfg.CAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no CA certificates found in %s", r.cfg.CAFile)
+	}
+
+	r.cert.Store(&cert)
+	r.pool.Store(pool)
+
+	r.cfg.Metrics.reloaded(r.cfg.Name)
+	r.cfg.Metrics.setExpiry(r.cfg.Name, r.cfg.CertFile, cert.Leaf.NotAfter)
+	if notAfter, ok := earliestExpiry(caPEM); ok {
+		r.cfg.Metrics.setExpiry(r.cfg.Name, r.cfg.CAFile, notAfter)
+	}
+	return nil
+}
+
+// changed reports whether any watched file differs from the last load.
+func (r *Reloader) changed() (bool, error) {
+	stamps, err := r.stat()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, s := range stamps {
+		if r.stamp[name] != s {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Reloader) stat() (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp, 3)
+	for _, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		// os.Stat follows symlinks, so Kubernetes-style secret volumes that
+		// swap a ..data link are detected as well.
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		stamps[name] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	return stamps, nil
+}
+
+// earliestExpiry returns the soonest NotAfter of the certificates in data.
+func earliestExpiry(data []byte) (time.Time, bool) {
+	var earliest time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+func appendH2(protos []string) []string {
+	for _, p := range protos {
+		if p == "h2" {
+			return protos
+		}
+	}
+	return append(protos, "h2")
+}
@@ -0,0 +1,109 @@
+package certreload_test
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"step-06_tls_encryption/internal/certreload"
+	"step-06_tls_encryption/internal/pki"
+)
+
+// handshake runs a TLS handshake between cfg and a server presenting cert.
+func handshake(t *testing.T, cfg *tls.Config, cert tls.Certificate) error {
+	t.Helper()
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", lis.Addr().String(), cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestClientConfigServerName(t *testing.T) {
+	ca, err := pki.NewAuthority("certreload test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(req pki.Request) tls.Certificate {
+		t.Helper()
+		cert, err := ca.IssueServer(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.TLSCertificate()
+	}
+	localhost := issue(pki.Request{
+		CommonName:  "localhost",
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	other := issue(pki.Request{
+		CommonName:  "other",
+		DNSNames:    []string{"other.example"},
+		IPAddresses: []net.IP{net.IPv4(10, 0, 0, 1)},
+	})
+
+	dir := t.TempDir()
+	files := certreload.Config{
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	client, err := ca.IssueClient(pki.Request{CommonName: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Write(files.CertFile, files.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Write(files.CAFile, filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := certreload.New(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		serverName string
+		cert       tls.Certificate
+		wantErr    bool
+	}{
+		{name: "DNS name", serverName: "localhost", cert: localhost},
+		{name: "IP address", serverName: "127.0.0.1", cert: localhost},
+		{name: "certificate for another name", serverName: "localhost", cert: other, wantErr: true},
+		{name: "certificate for another IP", serverName: "127.0.0.1", cert: other, wantErr: true},
+		{name: "no server name", cert: localhost, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshake(t, r.ClientConfig(&tls.Config{ServerName: tt.serverName}), tt.cert)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("handshake succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+// Package pki mints the certificates used by the TLS examples: a self-signed
+// certificate authority, server certificates with DNS/IP SANs and client
+// certificates with SPIFFE-style URI SANs. It only depends on the standard
+// crypto/x509 library, so tests can create throwaway PKI on the fly.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultCAValidity is how long a newly created CA is valid.
+	DefaultCAValidity = 5 * 365 * 24 * time.Hour
+	// DefaultLeafValidity is how long server and client certificates are valid.
+	DefaultLeafValidity = 365 * 24 * time.Hour
+
+	// clockSkew backdates NotBefore so freshly minted certs are accepted by
+	// peers whose clocks are slightly behind.
+	clockSkew = 5 * time.Minute
+)
+
+// Authority is a certificate authority able to sign leaf certificates.
+type Authority struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Request describes a leaf certificate to issue.
+type Request struct {
+	CommonName  string
+	DNSNames    []string
+	IPAddresses []net.IP
+	URIs        []*url.URL
+	Validity    time.Duration
+}
+
+// Issued is a signed certificate together with its private key.
+type Issued struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewAuthority creates a self-signed CA with the given common name.
+func NewAuthority(commonName string, validity time.Duration) (*Authority, error) {
+	if validity <= 0 {
+		validity = DefaultCAValidity
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+
+	skid, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          skid,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// LoadAuthority reads a CA certificate and private key from PEM files.
+func LoadAuthority(certFile, keyFile string) (*Authority, error) {
+	cert, err := LoadCertificate(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+
+	key, err := LoadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{Cert: cert, Key: key}, nil
+}
+
+// IssueServer signs a certificate usable for TLS server authentication.
+// Hostnames and IPs the server is reachable at must be listed as SANs.
+func (a *Authority) IssueServer(req Request) (*Issued, error) {
+	if len(req.DNSNames) == 0 && len(req.IPAddresses) == 0 {
+		return nil, fmt.Errorf("server certificate %q needs at least one DNS or IP SAN", req.CommonName)
+	}
+	return a.issue(req, x509.ExtKeyUsageServerAuth)
+}
+
+// IssueClient signs a certificate usable for TLS client authentication.
+func (a *Authority) IssueClient(req Request) (*Issued, error) {
+	return a.issue(req, x509.ExtKeyUsageClientAuth)
+}
+
+// Renew re-issues cert with a fresh key and validity period, keeping its
+// subject, SANs and extended key usages.
+func (a *Authority) Renew(cert *x509.Certificate, validity time.Duration) (*Issued, error) {
+	return a.issue(Request{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+		URIs:        cert.URIs,
+		Validity:    validity,
+	}, cert.ExtKeyUsage...)
+}
+
+func (a *Authority) issue(req Request, usages ...x509.ExtKeyUsage) (*Issued, error) {
+	if req.Validity <= 0 {
+		req.Validity = DefaultLeafValidity
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.After(a.Cert.NotAfter) {
+		return nil, fmt.Errorf("CA %q expired at %s", a.Cert.Subject.CommonName, a.Cert.NotAfter.Format(time.RFC3339))
+	}
+
+	notAfter := now.Add(req.Validity)
+	if notAfter.After(a.Cert.NotAfter) {
+		// A leaf must not outlive the CA that signed it.
+		notAfter = a.Cert.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: req.CommonName},
+		NotBefore:      now.Add(-clockSkew),
+		NotAfter:       notAfter,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    usages,
+		DNSNames:       req.DNSNames,
+		IPAddresses:    req.IPAddresses,
+		URIs:           req.URIs,
+		AuthorityKeyId: a.Cert.SubjectKeyId,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.Cert, key.Public(), a.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate %q: %v", req.CommonName, err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %q: %v", req.CommonName, err)
+	}
+
+	return &Issued{Cert: cert, Key: key}, nil
+}
+
+// TLSCertificate returns the issued certificate as a tls.Certificate chained
+// to nothing but the leaf, ready to be used in a tls.Config.
+func (i *Issued) TLSCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{i.Cert.Raw},
+		PrivateKey:  i.Key,
+		Leaf:        i.Cert,
+	}
+}
+
+// Write stores the certificate and key as PEM files.
+func (i *Issued) Write(certFile, keyFile string) error {
+	return writePair(i.Cert, i.Key, certFile, keyFile)
+}
+
+// Write stores the CA certificate and key as PEM files.
+func (a *Authority) Write(certFile, keyFile string) error {
+	return writePair(a.Cert, a.Key, certFile, keyFile)
+}
+
+// Pool returns a certificate pool containing only the CA certificate.
+func (a *Authority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(a.Cert)
+	return pool
+}
+
+// NeedsRenewal reports whether cert expires within the given window.
+func NeedsRenewal(cert *x509.Certificate, within time.Duration) bool {
+	return time.Now().Add(within).After(cert.NotAfter)
+}
+
+// SPIFFEID builds a SPIFFE-style URI such as spiffe://labs/greeter-client.
+func SPIFFEID(trustDomain, path string) (*url.URL, error) {
+	if trustDomain == "" {
+		return nil, fmt.Errorf("trust domain must not be empty")
+	}
+	u := &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/" + path}
+	if path == "" {
+		u.Path = ""
+	}
+	return u, nil
+}
+
+// LoadCertificate reads the first certificate from a PEM file.
+func LoadCertificate(certFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", certFile, err)
+	}
+	return cert, nil
+}
+
+// LoadKey reads a PKCS#8, PKCS#1 or SEC1 private key from a PEM file.
+func LoadKey(keyFile string) (crypto.Signer, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyFile)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q in %s", block.Type, keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", keyFile, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in %s cannot sign", keyFile)
+	}
+	return signer, nil
+}
+
+// EncodeCertificate returns cert in PEM form.
+func EncodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// EncodeKey returns key in PKCS#8 PEM form.
+func EncodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func writePair(cert *x509.Certificate, key crypto.Signer, certFile, keyFile string) error {
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0o700); err != nil {
+		return err
+	}
+
+	// Each file is replaced atomically, but not the pair: between the two
+	// renames a reader sees the new key with the old certificate.
+	// tls.LoadX509KeyPair rejects such a pair, and certreload keeps the
+	// previous credentials until the next check finds both files updated.
+	if err := writeFileAtomic(keyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certFile, EncodeCertificate(cert), 0o644)
+}
+
+// writeFileAtomic writes data to a temp file and renames it over name so
+// readers never observe a partially written file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func newKey() (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	return key, nil
+}
+
+func newSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	return serial, nil
+}
+
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %v", err)
+	}
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
+
+// CreateCRL signs a certificate revocation list listing entries. number must
+// grow with every new list; nextUpdate is when relying parties should expect
+// a fresh one.
+func (a *Authority) CreateCRL(entries []x509.RevocationListEntry, number *big.Int, nextUpdate time.Duration) (*x509.RevocationList, error) {
+	now := time.Now()
+	tmpl := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    number,
+		ThisUpdate:                now.Add(-clockSkew),
+		NextUpdate:                now.Add(nextUpdate),
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, a.Cert, a.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CRL: %v", err)
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL: %v", err)
+	}
+	return crl, nil
+}
+
+// LoadCRL reads a revocation list in PEM or DER form.
+func LoadCRL(crlFile string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(crlFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CRL: %v", err)
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("no CRL found in %s", crlFile)
+		}
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", crlFile, err)
+	}
+	return crl, nil
+}
+
+// WriteCRL stores crl as a PEM file.
+func WriteCRL(crlFile string, crl *x509.RevocationList) error {
+	if err := os.MkdirAll(filepath.Dir(crlFile), 0o755); err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.Raw})
+	return writeFileAtomic(crlFile, data, 0o644)
+}
@@ -0,0 +1,183 @@
+package pki_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"step-06_tls_encryption/internal/pki"
+)
+
+// files holds the paths of a written certificate and its key.
+type files struct {
+	cert, key string
+}
+
+// issue mints a CA, a server and a client certificate and writes them
+// under dir, like cmd/labs-certs does.
+func issue(t *testing.T, dir string) (ca, server, client files) {
+	t.Helper()
+	authority, err := pki.NewAuthority("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := authority.IssueServer(pki.Request{
+		CommonName:  "localhost",
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := pki.SPIFFEID("labs", "greeter-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := authority.IssueClient(pki.Request{CommonName: "greeter-client", URIs: []*url.URL{id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca = files{filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")}
+	server = files{filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")}
+	client = files{filepath.Join(dir, "client", "client.crt"), filepath.Join(dir, "client", "client.key")}
+	if err := authority.Write(ca.cert, ca.key); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverCert.Write(server.cert, server.key); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientCert.Write(client.cert, client.key); err != nil {
+		t.Fatal(err)
+	}
+	return ca, server, client
+}
+
+func load(t *testing.T, certFile string) *x509.Certificate {
+	t.Helper()
+	cert, err := pki.LoadCertificate(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	ca, server, client := issue(t, t.TempDir())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(load(t, ca.cert))
+
+	tests := []struct {
+		name    string
+		files   files
+		opts    x509.VerifyOptions
+		wantErr bool
+	}{
+		{name: "server by name", files: server, opts: x509.VerifyOptions{DNSName: "localhost", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}},
+		{name: "server by IP", files: server, opts: x509.VerifyOptions{DNSName: "127.0.0.1", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}},
+		{name: "server for another name", files: server, opts: x509.VerifyOptions{DNSName: "example.com"}, wantErr: true},
+		{name: "server as client", files: server, opts: x509.VerifyOptions{KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, wantErr: true},
+		{name: "client", files: client, opts: x509.VerifyOptions{KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}},
+		{name: "client as server", files: client, opts: x509.VerifyOptions{KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each key must belong to its certificate
+			if _, err := tls.LoadX509KeyPair(tt.files.cert, tt.files.key); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.opts.Roots = roots
+			chains, err := load(t, tt.files.cert).Verify(tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Verify() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if len(chains[0]) != 2 {
+				t.Errorf("chain has %d certificates, want leaf and CA", len(chains[0]))
+			}
+		})
+	}
+
+	// Private keys are for the owner only
+	for _, key := range []string{ca.key, server.key, client.key} {
+		info, err := os.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Errorf("%s has mode %v, want 0600", key, perm)
+		}
+	}
+}
+
+func TestVerifyOtherCA(t *testing.T) {
+	_, server, _ := issue(t, t.TempDir())
+	other, _, _ := issue(t, t.TempDir())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(load(t, other.cert))
+	if _, err := load(t, server.cert).Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost"}); err == nil {
+		t.Fatal("Verify() with the roots of another CA succeeded, want an error")
+	}
+}
+
+func TestCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca, server, client := issue(t, dir)
+	authority, err := pki.LoadAuthority(ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := load(t, client.cert)
+
+	crl, err := authority.CreateCRL([]x509.RevocationListEntry{{
+		SerialNumber:   revoked.SerialNumber,
+		RevocationTime: time.Now(),
+	}}, big.NewInt(1), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	if err := pki.WriteCRL(crlFile, crl); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := pki.LoadCRL(crlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.CheckSignatureFrom(load(t, ca.cert)); err != nil {
+		t.Fatalf("CRL signature: %v", err)
+	}
+	if loaded.Number.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("CRL number = %v, want 1", loaded.Number)
+	}
+
+	listed := func(cert *x509.Certificate) bool {
+		for _, e := range loaded.RevokedCertificateEntries {
+			if e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if !listed(revoked) {
+		t.Errorf("revoked serial %v is not in the CRL", revoked.SerialNumber)
+	}
+	if listed(load(t, server.cert)) {
+		t.Errorf("serial %v of the server is in the CRL", load(t, server.cert).SerialNumber)
+	}
+}
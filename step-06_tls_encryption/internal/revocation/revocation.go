@@ -0,0 +1,363 @@
+// Package revocation rejects client certificates listed in certificate
+// revocation lists (CRLs). The lists are verified against the CA, reloaded
+// periodically, and a configurable policy decides what happens when a list
+// is past its next-update time.
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// StalePolicy decides what to do when no fresh CRL covers a certificate.
+type StalePolicy int
+
+const (
+	// FailClosed rejects certificates whose revocation status is unknown.
+	FailClosed StalePolicy = iota
+	// FailOpen accepts them and logs a warning once per missing or stale
+	// list.
+	FailOpen
+)
+
+// ParseStalePolicy parses "fail-closed" or "fail-open".
+func ParseStalePolicy(s string) (StalePolicy, error) {
+	switch s {
+	case "fail-closed":
+		return FailClosed, nil
+	case "fail-open":
+		return FailOpen, nil
+	default:
+		return FailClosed, fmt.Errorf("unknown stale CRL policy %q, want fail-closed or fail-open", s)
+	}
+}
+
+func (p StalePolicy) String() string {
+	if p == FailOpen {
+		return "fail-open"
+	}
+	return "fail-closed"
+}
+
+// DefaultInterval is how often CRLs are reloaded.
+const DefaultInterval = time.Minute
+
+// Config describes where the CRLs come from and how to treat them.
+type Config struct {
+	// CRLFiles are PEM or DER encoded revocation lists.
+	CRLFiles []string
+	// CAFile holds the CA certificates the CRLs must be signed by.
+	CAFile string
+	// Interval between reloads. Defaults to DefaultInterval.
+	Interval time.Duration
+	// Stale applies when the CRL for an issuer is missing or expired.
+	Stale StalePolicy
+	// DeferToRPC lets a revoked client finish the TLS handshake so that the
+	// interceptors can reject its calls with a clear Unauthenticated status.
+	// Otherwise the handshake is aborted and the client only sees a
+	// transport error (Unavailable).
+	DeferToRPC bool
+}
+
+// RevokedError is returned for certificates listed in a CRL.
+type RevokedError struct {
+	Serial    *big.Int
+	Subject   string
+	RevokedAt time.Time
+}
+
+func (e *RevokedError) Error() string {
+	return fmt.Sprintf("certificate %q (serial %x) was revoked at %s",
+		e.Subject, e.Serial, e.RevokedAt.Format(time.RFC3339))
+}
+
+// StaleError is returned under FailClosed when the revocation status of a
+// certificate cannot be determined.
+type StaleError struct {
+	Issuer string
+	Reason string
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("revocation status unknown for issuer %q: %s", e.Issuer, e.Reason)
+}
+
+// list is a verified CRL indexed by serial number.
+type list struct {
+	file       string
+	rawIssuer  []byte
+	nextUpdate time.Time
+	revoked    map[string]time.Time
+}
+
+// Checker holds the current CRLs.
+type Checker struct {
+	cfg Config
+
+	mu    sync.RWMutex
+	lists []*list
+
+	// warned holds the reasons already logged under FailOpen.
+	warnMu sync.Mutex
+	warned map[string]bool
+}
+
+// New loads the CRLs once. All files must load under FailClosed; under
+// FailOpen, unusable files are logged and skipped.
+func New(cfg Config) (*Checker, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+
+	c := &Checker{cfg: cfg, warned: make(map[string]bool)}
+	if err := c.Reload(); err != nil && cfg.Stale == FailClosed {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the CA and every CRL. Lists that fail to load keep their
+// previous version, which eventually goes stale.
+func (c *Checker) Reload() error {
+	issuers, err := loadCAs(c.cfg.CAFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := make(map[string]*list, len(c.lists))
+	for _, l := range c.lists {
+		previous[l.file] = l
+	}
+
+	var firstErr error
+	lists := make([]*list, 0, len(c.cfg.CRLFiles))
+	for _, file := range c.cfg.CRLFiles {
+		l, err := loadList(file, issuers)
+		if err != nil {
+			log.Printf("❌ failed to load CRL: %v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			if old, ok := previous[file]; ok {
+				lists = append(lists, old)
+			}
+			continue
+		}
+		lists = append(lists, l)
+	}
+
+	c.lists = lists
+	return firstErr
+}
+
+// Watch reloads the CRLs every interval until ctx is done.
+func (c *Checker) Watch(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Errors are logged by Reload.
+			_ = c.Reload()
+		}
+	}
+}
+
+// Check returns a *RevokedError if cert is revoked, and a *StaleError if its
+// status is unknown and the policy is FailClosed.
+func (c *Checker) Check(cert *x509.Certificate) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	covered := false
+	var stale string
+
+	for _, l := range c.lists {
+		if !bytes.Equal(l.rawIssuer, cert.RawIssuer) {
+			continue
+		}
+
+		if revokedAt, ok := l.revoked[string(cert.SerialNumber.Bytes())]; ok {
+			// A revocation stays valid even if the list is stale.
+			return &RevokedError{Serial: cert.SerialNumber, Subject: cert.Subject.CommonName, RevokedAt: revokedAt}
+		}
+
+		if !l.nextUpdate.IsZero() && now.After(l.nextUpdate) {
+			stale = fmt.Sprintf("%s is stale since %s", l.file, l.nextUpdate.Format(time.RFC3339))
+			continue
+		}
+		covered = true
+	}
+
+	if covered {
+		return nil
+	}
+	if stale == "" {
+		stale = "no CRL loaded for this issuer"
+	}
+
+	if c.cfg.Stale == FailOpen {
+		c.warnOnce(cert.Issuer.CommonName, stale)
+		return nil
+	}
+	return &StaleError{Issuer: cert.Issuer.CommonName, Reason: stale}
+}
+
+// warnOnce logs that certificates of issuer are accepted unchecked, once per
+// reason. Every handshake and call would log it otherwise.
+func (c *Checker) warnOnce(issuer, reason string) {
+	c.warnMu.Lock()
+	defer c.warnMu.Unlock()
+	if c.warned[issuer+"\x00"+reason] {
+		return
+	}
+	c.warned[issuer+"\x00"+reason] = true
+	log.Printf("⚠️ accepting certificates of %q without revocation check: %s", issuer, reason)
+}
+
+// VerifyPeerCertificate is meant for tls.Config.VerifyPeerCertificate on a
+// server requiring verified client certificates.
+func (c *Checker) VerifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil
+	}
+
+	leaf := verifiedChains[0][0]
+	err := c.Check(leaf)
+	if err == nil {
+		return nil
+	}
+
+	if c.cfg.DeferToRPC {
+		log.Printf("🚫 accepting handshake, calls will be rejected: %v", err)
+		return nil
+	}
+	log.Printf("🚫 rejecting client certificate: %v", err)
+	return err
+}
+
+// checkPeer re-checks the client certificate of the current call. This also
+// catches connections established before the certificate was revoked.
+func (c *Checker) checkPeer(ctx context.Context) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	if err := c.Check(tlsInfo.State.VerifiedChains[0][0]); err != nil {
+		return status.Errorf(codes.Unauthenticated, "client certificate rejected: %v", err)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor rejects calls from revoked client certificates.
+func (c *Checker) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := c.checkPeer(ctx); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects streams from revoked client certificates.
+func (c *Checker) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := c.checkPeer(ss.Context()); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func loadList(file string, issuers []*x509.Certificate) (*list, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+
+	// Only trust lists signed by one of our CAs.
+	var signer *x509.Certificate
+	for _, ca := range issuers {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			signer = ca
+			break
+		}
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("%s is not signed by a trusted CA", file)
+	}
+
+	l := &list{
+		file:       file,
+		rawIssuer:  signer.RawSubject,
+		nextUpdate: crl.NextUpdate,
+		revoked:    make(map[string]time.Time, len(crl.RevokedCertificateEntries)),
+	}
+	for _, e := range crl.RevokedCertificateEntries {
+		l.revoked[string(e.SerialNumber.Bytes())] = e.RevocationTime
+	}
+	return l, nil
+}
+
+func loadCAs(caFile string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+
+	var cas []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+		}
+		cas = append(cas, cert)
+	}
+
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no CA certificates found in %s", caFile)
+	}
+	return cas, nil
+}
@@ -0,0 +1,257 @@
+package revocation_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	pb "step-06_tls_encryption/internal/greeter"
+	"step-06_tls_encryption/internal/pki"
+	"step-06_tls_encryption/internal/revocation"
+)
+
+// fixture is a CA on disk, with one revoked and one valid client
+// certificate.
+type fixture struct {
+	dir     string
+	ca      *pki.Authority
+	caFile  string
+	revoked *pki.Issued
+	valid   *pki.Issued
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	f := &fixture{dir: t.TempDir()}
+
+	var err error
+	f.ca, err = pki.NewAuthority("revocation test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.caFile = filepath.Join(f.dir, "ca.crt")
+	if err := f.ca.Write(f.caFile, filepath.Join(f.dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.revoked, err = f.ca.IssueClient(pki.Request{CommonName: "revoked"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.valid, err = f.ca.IssueClient(pki.Request{CommonName: "valid"}); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// writeCRL writes a list signed by signer that revokes f.revoked and is due
+// for an update after nextUpdate, and returns its path.
+func (f *fixture) writeCRL(t *testing.T, name string, signer *pki.Authority, nextUpdate time.Duration) string {
+	t.Helper()
+	crl, err := signer.CreateCRL([]x509.RevocationListEntry{{
+		SerialNumber:   f.revoked.Cert.SerialNumber,
+		RevocationTime: time.Now(),
+	}}, big.NewInt(1), nextUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(f.dir, name)
+	if err := pki.WriteCRL(file, crl); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCheck(t *testing.T) {
+	f := newFixture(t)
+	other, err := pki.NewAuthority("untrusted CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := f.writeCRL(t, "fresh.crl", f.ca, time.Hour)
+	// NextUpdate a minute ago, still after ThisUpdate
+	stale := f.writeCRL(t, "stale.crl", f.ca, -time.Minute)
+	untrusted := f.writeCRL(t, "untrusted.crl", other, time.Hour)
+
+	tests := []struct {
+		name        string
+		crl         string
+		policy      revocation.StalePolicy
+		cert        *pki.Issued
+		wantNewErr  bool
+		wantRevoked bool
+		wantStale   bool
+	}{
+		{name: "revoked serial", crl: fresh, cert: f.revoked, wantRevoked: true},
+		{name: "fresh CRL", crl: fresh, cert: f.valid},
+		{name: "stale CRL, fail closed", crl: stale, cert: f.valid, wantStale: true},
+		{name: "stale CRL, fail open", crl: stale, policy: revocation.FailOpen, cert: f.valid},
+		{name: "revoked serial on stale CRL, fail open", crl: stale, policy: revocation.FailOpen, cert: f.revoked, wantRevoked: true},
+		{name: "untrusted signer, fail closed", crl: untrusted, cert: f.valid, wantNewErr: true},
+		{name: "untrusted signer, fail open", crl: untrusted, policy: revocation.FailOpen, cert: f.revoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := revocation.New(revocation.Config{
+				CRLFiles: []string{tt.crl},
+				CAFile:   f.caFile,
+				Stale:    tt.policy,
+			})
+			if tt.wantNewErr {
+				if err == nil {
+					t.Fatal("New() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			err = checker.Check(tt.cert.Cert)
+			var revoked *revocation.RevokedError
+			var staleErr *revocation.StaleError
+			switch {
+			case tt.wantRevoked:
+				if !errors.As(err, &revoked) {
+					t.Errorf("Check() error = %v, want a RevokedError", err)
+				}
+			case tt.wantStale:
+				if !errors.As(err, &staleErr) {
+					t.Errorf("Check() error = %v, want a StaleError", err)
+				}
+			case err != nil:
+				t.Errorf("Check() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestFailOpenWarnsOnce(t *testing.T) {
+	f := newFixture(t)
+	stale := f.writeCRL(t, "stale.crl", f.ca, -time.Minute)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	checker, err := revocation.New(revocation.Config{
+		CRLFiles: []string{stale},
+		CAFile:   f.caFile,
+		Stale:    revocation.FailOpen,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := checker.Check(f.valid.Cert); err != nil {
+			t.Fatalf("Check() error = %v, want nil", err)
+		}
+	}
+	if n := strings.Count(buf.String(), "without revocation check"); n != 1 {
+		t.Errorf("logged %d warnings for one stale CRL, want 1:\n%s", n, buf.String())
+	}
+}
+
+type greeter struct {
+	pb.UnimplementedGreeterServer
+}
+
+func (greeter) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	return &pb.HelloReply{Message: "Hello " + in.GetName()}, nil
+}
+
+// startServer runs a greeter checking client certificates with checker
+// during the handshake and on every call, like cmd/server, and returns its
+// address.
+func startServer(t *testing.T, f *fixture, checker *revocation.Checker) string {
+	t.Helper()
+	srvCert, err := f.ca.IssueServer(pki.Request{
+		CommonName:  "localhost",
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates:          []tls.Certificate{srvCert.TLSCertificate()},
+			ClientAuth:            tls.RequireAndVerifyClientCert,
+			ClientCAs:             f.ca.Pool(),
+			MinVersion:            tls.VersionTLS13,
+			VerifyPeerCertificate: checker.VerifyPeerCertificate,
+		})),
+		grpc.UnaryInterceptor(checker.UnaryServerInterceptor()),
+	)
+	pb.RegisterGreeterServer(s, greeter{})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+func TestDeferToRPC(t *testing.T) {
+	f := newFixture(t)
+	crl := f.writeCRL(t, "ca.crl", f.ca, time.Hour)
+
+	tests := []struct {
+		name       string
+		deferToRPC bool
+		cert       *pki.Issued
+		wantCode   codes.Code
+	}{
+		// The handshake is accepted, so the call reaches the interceptor
+		{name: "revoked, deferred to RPC", deferToRPC: true, cert: f.revoked, wantCode: codes.Unauthenticated},
+		{name: "revoked, rejected in handshake", cert: f.revoked, wantCode: codes.Unavailable},
+		{name: "valid, deferred to RPC", deferToRPC: true, cert: f.valid, wantCode: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := revocation.New(revocation.Config{
+				CRLFiles:   []string{crl},
+				CAFile:     f.caFile,
+				DeferToRPC: tt.deferToRPC,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := startServer(t, f, checker)
+
+			conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+				Certificates: []tls.Certificate{tt.cert.TLSCertificate()},
+				RootCAs:      f.ca.Pool(),
+				MinVersion:   tls.VersionTLS13,
+			})))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = pb.NewGreeterClient(conn).SayHello(ctx, &pb.HelloRequest{Name: "test"})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("SayHello() error = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
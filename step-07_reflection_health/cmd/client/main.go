@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -9,13 +10,16 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/health" // registers client-side health checking
 	"google.golang.org/grpc/health/grpc_health_v1"
 
 	greeterpb "step-07_reflection_health/internal/greeter"
+	"step-07_reflection_health/internal/healthwatch"
 )
 
 const (
 	address = "localhost:50051"
+	service = "greeter.Greeter"
 )
 
 func checkHealth(client grpc_health_v1.HealthClient) {
@@ -23,7 +27,7 @@ func checkHealth(client grpc_health_v1.HealthClient) {
 	defer cancel()
 
 	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{
-		Service: "greeter.Greeter",
+		Service: service,
 	})
 
 	if err != nil {
@@ -45,6 +49,25 @@ func callSayHello(client greeterpb.GreeterClient, name string) {
 	log.Printf("Greeting: %s at %v", r.GetMessage(), r.GetTimestamp().AsTime().Format(time.RFC3339))
 }
 
+// keepGreeting calls SayHello every second for d, logging failures instead
+// of exiting. While the server reports NOT_SERVING the calls fail fast.
+func keepGreeting(client greeterpb.GreeterClient, watcher *healthwatch.Watcher, d time.Duration) {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		start := time.Now()
+		r, err := client.SayHello(ctx, &greeterpb.HelloRequest{Name: "Watcher"})
+		cancel()
+
+		if err != nil {
+			log.Printf("[%s] SayHello failed after %v: %v", watcher.Status(), time.Since(start).Round(time.Microsecond), err)
+		} else {
+			log.Printf("[%s] Greeting: %s", watcher.Status(), r.GetMessage())
+		}
+		time.Sleep(time.Second)
+	}
+}
+
 func callStreamGreetings(client greeterpb.GreeterClient, name string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -110,13 +133,35 @@ func callChat(client greeterpb.GreeterClient, messages []string) {
 }
 
 func main() {
-	// Set up a connection to the server.
-	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	watch := flag.Duration("watch", 0, "Keep calling SayHello for this long while following the health status")
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Follow the service's health status and fail calls fast while it is down
+	watcher := healthwatch.New(service, healthwatch.Options{
+		OnChange: func(t healthwatch.Transition) {
+			log.Printf("Health of %s changed: %s -> %s", service, t.From, t.To)
+		},
+	})
+
+	// Set up a connection to the server. The service config also enables
+	// gRPC's client-side health checking, so the channel stops picking a
+	// server that reports NOT_SERVING.
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(healthwatch.ServiceConfig(service)),
+		grpc.WithChainUnaryInterceptor(watcher.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(watcher.StreamClientInterceptor()),
+	)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 
+	go watcher.Run(ctx, conn)
+
 	// Create clients
 	greeterClient := greeterpb.NewGreeterClient(conn)
 	healthClient := grpc_health_v1.NewHealthClient(conn)
@@ -125,6 +170,12 @@ func main() {
 	fmt.Println("=== Checking service health ===")
 	checkHealth(healthClient)
 
+	if *watch > 0 {
+		fmt.Printf("\n=== Watching health for %v ===\n", *watch)
+		keepGreeting(greeterClient, watcher, *watch)
+		return
+	}
+
 	// Test unary RPC
 	fmt.Println("\n=== Testing SayHello (Unary RPC) ===")
 	callSayHello(greeterClient, "World")
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"time"
 
 	"google.golang.org/grpc"
@@ -12,10 +14,23 @@ import (
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/protobuf/types/known/timestamppb"
-	
+
 	greeterpb "step-07_reflection_health/internal/greeter"
+	"step-07_reflection_health/internal/healthcheck"
 )
 
+// maintenanceFile takes the Greeter out of rotation while it exists.
+const maintenanceFile = "maintenance"
+
+// notInMaintenance fails while the maintenance file exists, so operators can
+// drain the service with `touch maintenance`.
+func notInMaintenance(ctx context.Context) error {
+	if _, err := os.Stat(maintenanceFile); err == nil {
+		return errors.New("maintenance mode is on")
+	}
+	return nil
+}
+
 type server struct {
 	greeterpb.UnimplementedGreeterServer
 }
@@ -72,12 +87,29 @@ func main() {
 	// Register reflection service on gRPC server
 	reflection.Register(s)
 	
-	// Register health check service
+	// Register health check service, driven by probes
 	healthServer := health.NewServer()
-	healthServer.SetServingStatus("greeter.Greeter", grpc_health_v1.HealthCheckResponse_SERVING)
-	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	healthManager := healthcheck.NewManager(healthServer)
+	healthManager.Register(healthcheck.Probe{
+		Name:             "disk-space",
+		Check:            healthcheck.DiskSpace(".", 100<<20),
+		Services:         []string{"greeter.Greeter"},
+		Interval:         30 * time.Second,
+		FailureThreshold: 1,
+	})
+	healthManager.Register(healthcheck.Probe{
+		Name:             "maintenance",
+		Check:            notInMaintenance,
+		Services:         []string{"greeter.Greeter"},
+		Interval:         time.Second,
+		FailureThreshold: 1,
+	})
 	grpc_health_v1.RegisterHealthServer(s, healthServer)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go healthManager.Run(ctx)
+
 	log.Printf("Server listening at %v", lis.Addr())
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
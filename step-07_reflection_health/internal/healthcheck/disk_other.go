@@ -0,0 +1,9 @@
+//go:build !unix
+
+package healthcheck
+
+import "errors"
+
+func freeBytes(path string) (uint64, error) {
+	return 0, errors.New("disk space checks are not supported on this platform")
+}
@@ -0,0 +1,246 @@
+// Package healthwatch follows a service's status through the standard
+// grpc.health.v1.Health/Watch stream and lets clients fail fast while the
+// service reports NOT_SERVING, instead of waiting for each call to time out.
+//
+// Calls fail fast on NOT_SERVING and SERVICE_UNKNOWN, and while the Watch
+// stream is broken. With ServiceConfig, the channel only routes to backends
+// its own health checks find serving, and the Watch stream is routed the
+// same way: once a NOT_SERVING backend breaks the stream, for instance by
+// restarting, it cannot be opened again until the backend serves. Calls
+// would fail with Unavailable from the channel in the meantime, so they
+// are failed here first. Only before the first update do calls go through
+// on an UNKNOWN status.
+package healthwatch
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// ServiceConfig enables gRPC's built-in client-side health checking for
+// service. Health checking only applies to load balancing policies that
+// support it, so round_robin is selected as well. Import
+// google.golang.org/grpc/health for the checks to be registered.
+func ServiceConfig(service string) string {
+	js, err := json.Marshal(map[string]any{
+		"loadBalancingPolicy": "round_robin",
+		"healthCheckConfig":   map[string]string{"serviceName": service},
+	})
+	if err != nil {
+		// Maps of strings always marshal
+		panic(err)
+	}
+	return string(js)
+}
+
+// Transition is a change of the watched status.
+type Transition struct {
+	From, To healthpb.HealthCheckResponse_ServingStatus
+}
+
+// Options tune a Watcher.
+type Options struct {
+	// OnChange is called for every transition, from the watch goroutine.
+	OnChange func(Transition)
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	// when the Watch stream breaks.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Watcher tracks the serving status of one service.
+type Watcher struct {
+	service string
+	opts    Options
+
+	changes chan Transition
+
+	mu     sync.RWMutex
+	status healthpb.HealthCheckResponse_ServingStatus
+	// broken is set while the Watch stream is down.
+	broken bool
+}
+
+// New returns a watcher for service. It is created before the connection so
+// that its interceptors can be passed to grpc.Dial; call Run with the
+// connection to start watching.
+func New(service string, opts Options) *Watcher {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 200 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Second
+	}
+
+	return &Watcher{
+		service: service,
+		opts:    opts,
+		changes: make(chan Transition, 16),
+		status:  healthpb.HealthCheckResponse_UNKNOWN,
+	}
+}
+
+// Status returns the last known status. It is UNKNOWN until the server
+// answers and whenever the Watch stream is broken.
+func (w *Watcher) Status() healthpb.HealthCheckResponse_ServingStatus {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.status
+}
+
+// Changes delivers status transitions. If the reader falls behind, the
+// oldest undelivered transitions are dropped.
+func (w *Watcher) Changes() <-chan Transition {
+	return w.changes
+}
+
+// Run keeps a Watch stream on conn open until ctx is done, reconnecting
+// with exponential backoff when it breaks.
+func (w *Watcher) Run(ctx context.Context, conn grpc.ClientConnInterface) {
+	client := healthpb.NewHealthClient(conn)
+	backoff := w.opts.MinBackoff
+
+	for {
+		received, err := w.watch(ctx, client)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if status.Code(err) == codes.Unimplemented {
+			// Servers without a health service cannot tell us anything,
+			// so don't block calls to them.
+			log.Printf("health service not available on server, assuming %s is serving", w.service)
+			w.set(healthpb.HealthCheckResponse_SERVING)
+			return
+		}
+
+		// A stream that delivered updates was healthy, so start over with
+		// a short delay.
+		if received {
+			backoff = w.opts.MinBackoff
+		}
+
+		// The stream is gone, so we no longer know the status.
+		w.interrupted()
+		log.Printf("health watch for %q interrupted: %v (retrying in %v)", w.service, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > w.opts.MaxBackoff {
+			backoff = w.opts.MaxBackoff
+		}
+	}
+}
+
+// watch follows one Watch stream until it breaks. It reports whether any
+// update was received.
+func (w *Watcher) watch(ctx context.Context, client healthpb.HealthClient) (bool, error) {
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: w.service})
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		w.set(resp.GetStatus())
+	}
+}
+
+func (w *Watcher) set(s healthpb.HealthCheckResponse_ServingStatus) {
+	w.update(s, false)
+}
+
+// interrupted marks the status UNKNOWN until the Watch stream is back.
+func (w *Watcher) interrupted() {
+	w.update(healthpb.HealthCheckResponse_UNKNOWN, true)
+}
+
+func (w *Watcher) update(s healthpb.HealthCheckResponse_ServingStatus, broken bool) {
+	w.mu.Lock()
+	prev := w.status
+	w.status = s
+	w.broken = broken
+	w.mu.Unlock()
+
+	if prev == s {
+		return
+	}
+
+	t := Transition{From: prev, To: s}
+	if w.opts.OnChange != nil {
+		w.opts.OnChange(t)
+	}
+
+	for {
+		select {
+		case w.changes <- t:
+			return
+		default:
+		}
+		// Make room by dropping the oldest transition.
+		select {
+		case <-w.changes:
+		default:
+		}
+	}
+}
+
+// check returns an Unavailable error while the server reports the service
+// as down or the Watch stream is broken, see the package doc. Health RPCs
+// are never gated, or the watcher could not recover.
+func (w *Watcher) check(method string) error {
+	if strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+		return nil
+	}
+
+	w.mu.RLock()
+	s, broken := w.status, w.broken
+	w.mu.RUnlock()
+
+	switch {
+	case s == healthpb.HealthCheckResponse_NOT_SERVING, s == healthpb.HealthCheckResponse_SERVICE_UNKNOWN:
+		return status.Errorf(codes.Unavailable, "%s is %s, failing fast", w.service, s)
+	case broken:
+		return status.Errorf(codes.Unavailable, "health watch for %s is down, failing fast", w.service)
+	}
+	return nil
+}
+
+// UnaryClientInterceptor fails unary calls fast while the service is down.
+func (w *Watcher) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if err := w.check(method); err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor fails new streams fast while the service is down.
+func (w *Watcher) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if err := w.check(method); err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
@@ -2,16 +2,30 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"net/http"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 
+	"step-08_prometheus_metrics/internal/admin"
 	greeterpb "step-08_prometheus_metrics/internal/greeter"
 )
 
 func main() {
+	adminAddr := flag.String("admin", "", "Address of the admin server (e.g. :9091); disabled when empty")
+	room := flag.String("room", "lobby", "Chat room, sent in the x-chat-room header")
+	flag.Parse()
+
+	// The admin server serves metrics, probes, pprof and channelz
+	var adminServer *admin.Server
+	if *adminAddr != "" {
+		adminServer = admin.New(admin.Config{Addr: *adminAddr})
+	}
+
 	// Set up a connection to the server
 	conn, err := grpc.Dial("localhost:50051",
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -21,6 +35,16 @@ func main() {
 	}
 	defer conn.Close()
 
+	if adminServer != nil {
+		adminServer.AddCheck("greeter-conn", admin.ConnReady(conn))
+		go func() {
+			log.Printf("Starting admin server on http://localhost%s", *adminAddr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start admin server: %v", err)
+			}
+		}()
+	}
+
 	// Create a client
 	c := greeterpb.NewGreeterClient(conn)
 
@@ -29,7 +53,7 @@ func main() {
 	// Test Server Streaming
 	testStreamGreetings(c)
 	// Test Bidirectional Streaming
-	testChat(c)
+	testChat(c, *room)
 }
 
 func testSayHello(c greeterpb.GreeterClient) {
@@ -64,10 +88,11 @@ func testStreamGreetings(c greeterpb.GreeterClient) {
 	}
 }
 
-func testChat(c greeterpb.GreeterClient) {
+func testChat(c greeterpb.GreeterClient, room string) {
 	log.Println("\n--- Testing Chat ---")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-chat-room", room)
 
 	stream, err := c.Chat(ctx)
 	if err != nil {
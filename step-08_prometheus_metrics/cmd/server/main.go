@@ -6,23 +6,40 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"step-08_prometheus_metrics/internal/admin"
+	"step-08_prometheus_metrics/internal/appmetrics"
 	greeterpb "step-08_prometheus_metrics/internal/greeter"
 )
 
+const adminAddr = ":9090"
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
 type server struct {
 	greeterpb.UnimplementedGreeterServer
+	metrics *appmetrics.Metrics
 }
 
 func (s *server) SayHello(ctx context.Context, in *greeterpb.HelloRequest) (*greeterpb.HelloReply, error) {
 	log.Printf("Received: %v", in.GetName())
+	s.metrics.ObserveGreeting(in.GetName())
 	return &greeterpb.HelloReply{
 		Message:   fmt.Sprintf("Hello %s", in.GetName()),
 		Timestamp: timestamppb.Now(),
@@ -43,6 +60,9 @@ func (s *server) StreamGreetings(in *greeterpb.HelloRequest, stream greeterpb.Gr
 }
 
 func (s *server) Chat(stream greeterpb.Greeter_ChatServer) error {
+	done := s.metrics.ChatStarted(stream.Context())
+	defer done()
+
 	for {
 		in, err := stream.Recv()
 		if err != nil {
@@ -61,14 +81,31 @@ func (s *server) Chat(stream greeterpb.Greeter_ChatServer) error {
 }
 
 func main() {
+	// Register application metrics next to the go-grpc-prometheus ones
+	metrics := appmetrics.New(prometheus.DefaultRegisterer)
+	appmetrics.RegisterBuildInfo(prometheus.DefaultRegisterer, version, commit)
+
+	// The health server backs both the gRPC health service and /readyz
+	healthServer := health.NewServer()
+
+	// The admin server serves metrics, probes, pprof and channelz
+	adminServer := admin.New(admin.Config{
+		Addr:   adminAddr,
+		Health: healthServer,
+		Ready: map[string]admin.Check{
+			"greeter": admin.HealthCheck(healthServer, "greeter.Greeter"),
+		},
+	})
+
 	// Create gRPC server with Prometheus interceptors
 	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
+		grpc.ChainStreamInterceptor(grpc_prometheus.StreamServerInterceptor, metrics.StreamServerInterceptor()),
 		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
 	)
 
-	// Register service
-	greeterpb.RegisterGreeterServer(s, &server{})
+	// Register services
+	greeterpb.RegisterGreeterServer(s, &server{metrics: metrics})
+	healthpb.RegisterHealthServer(s, healthServer)
 
 	// Enable reflection for debugging
 	reflection.Register(s)
@@ -79,18 +116,11 @@ func main() {
 	)
 	grpc_prometheus.Register(s)
 
-	// Start metrics server in a separate goroutine
+	// Start admin server (metrics, probes, pprof, channelz) in a separate goroutine
 	go func() {
-		metricsMux := http.NewServeMux()
-		metricsMux.Handle("/metrics", promhttp.Handler())
-		metricsServer := &http.Server{
-			Addr:    ":9090",
-			Handler: metricsMux,
-		}
-
-		log.Printf("Starting metrics server on http://localhost:9090/metrics")
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start metrics server: %v", err)
+		log.Printf("Starting admin server on http://localhost%s (/metrics, /livez, /readyz, /debug/pprof/)", adminAddr)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start admin server: %v", err)
 		}
 	}()
 
@@ -100,8 +130,32 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
+	// Report ready once everything is registered
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("greeter.Greeter", healthpb.HealthCheckResponse_SERVING)
+
+	// On SIGINT/SIGTERM, fail readiness first, then drain in-flight calls.
+	// The admin server stays up while draining, and main waits for it to
+	// shut down once Serve returns.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		log.Println("Shutting down...")
+		healthServer.Shutdown()
+		s.GracefulStop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		adminServer.Shutdown(ctx)
+	}()
+
 	log.Printf("Server listening at %v", lis.Addr())
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
+	<-stopped
 }
@@ -0,0 +1,207 @@
+// Package admin serves the operational endpoints of a binary on a single
+// listener:
+//
+//	/livez           the process is up
+//	/readyz          every readiness check passes
+//	/metrics         Prometheus metrics
+//	/debug/pprof/    Go profiling
+//
+// The same port also speaks gRPC (cleartext HTTP/2) for the channelz,
+// health and reflection services, so live connections can be inspected
+// with e.g. grpcurl -plaintext localhost:9090 grpc.channelz.v1.Channelz/GetServers.
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	channelzsvc "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// Check reports a reason not to receive traffic by returning an error.
+type Check func(ctx context.Context) error
+
+// Config describes what the admin listener serves.
+type Config struct {
+	// Addr to listen on, e.g. ":9090".
+	Addr string
+	// Gatherer provides /metrics. Defaults to prometheus.DefaultGatherer.
+	Gatherer prometheus.Gatherer
+	// Ready holds the named checks behind /readyz.
+	Ready map[string]Check
+	// Health, if set, is also exposed over gRPC on the admin port.
+	Health *health.Server
+	// CheckTimeout bounds each readiness check. Defaults to one second.
+	CheckTimeout time.Duration
+}
+
+// Server is the admin listener.
+type Server struct {
+	cfg  Config
+	grpc *grpc.Server
+	http *http.Server
+
+	mu    sync.RWMutex
+	ready map[string]Check
+}
+
+// New builds the admin server. gRPC tracks every server and connection of
+// the process in channelz whether or not this server exists, so the order
+// of creation does not matter.
+func New(cfg Config) *Server {
+	if cfg.Gatherer == nil {
+		cfg.Gatherer = prometheus.DefaultGatherer
+	}
+	if cfg.CheckTimeout <= 0 {
+		cfg.CheckTimeout = time.Second
+	}
+
+	s := &Server{cfg: cfg, grpc: grpc.NewServer(), ready: make(map[string]Check)}
+	for name, check := range cfg.Ready {
+		s.ready[name] = check
+	}
+
+	channelzsvc.RegisterChannelzServiceToServer(s.grpc)
+	if cfg.Health != nil {
+		healthpb.RegisterHealthServer(s.grpc, cfg.Health)
+	}
+	reflection.Register(s.grpc)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", s.livez)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.Handle("/metrics", promhttp.HandlerFor(cfg.Gatherer, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// gRPC clients use HTTP/2 with prior knowledge, everything else is
+	// plain HTTP/1.1.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	s.http = &http.Server{
+		Addr:      cfg.Addr,
+		Handler:   s.route(mux),
+		Protocols: protocols,
+	}
+	return s
+}
+
+// AddCheck adds a readiness check, for dependencies that only exist after
+// the admin server, such as client connections.
+func (s *Server) AddCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready[name] = check
+}
+
+// ListenAndServe serves until Shutdown is called, after which it returns
+// http.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	return s.http.ListenAndServe()
+}
+
+// Shutdown stops the admin listener.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.grpc.Stop()
+	return s.http.Shutdown(ctx)
+}
+
+// route sends gRPC requests to the admin gRPC server.
+func (s *Server) route(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			s.grpc.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) livez(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz runs every check and answers 503 if any fails. The body lists the
+// result of each check.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	checks := make(map[string]Check, len(s.ready))
+	names := make([]string, 0, len(s.ready))
+	for name, check := range s.ready {
+		checks[name] = check
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+
+	var body strings.Builder
+	ready := true
+	for _, name := range names {
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.CheckTimeout)
+		err := checks[name](ctx)
+		cancel()
+
+		if err != nil {
+			ready = false
+			fmt.Fprintf(&body, "[-] %s failed: %v\n", name, err)
+		} else {
+			fmt.Fprintf(&body, "[+] %s ok\n", name)
+		}
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		body.WriteString("readyz check failed\n")
+	} else {
+		body.WriteString("readyz check passed\n")
+	}
+	fmt.Fprint(w, body.String())
+}
+
+// HealthCheck is ready while the health server reports service as SERVING.
+func HealthCheck(hs healthpb.HealthServer, service string) Check {
+	return func(ctx context.Context) error {
+		resp, err := hs.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("service %q is %s", service, resp.GetStatus())
+		}
+		return nil
+	}
+}
+
+// ConnReady is ready while conn is connected or idle. An idle connection
+// is asked to connect, so it does not stay idle forever.
+func ConnReady(conn *grpc.ClientConn) Check {
+	return func(ctx context.Context) error {
+		switch state := conn.GetState(); state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Idle:
+			conn.Connect()
+			return nil
+		default:
+			return fmt.Errorf("connection to %s is %s", conn.Target(), state)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package appmetrics records application-level metrics for the Greeter
+// service, next to the generic RPC metrics of go-grpc-prometheus. Labels
+// derived from user input go through a LabelGuard, so clients cannot
+// create an unbounded number of series.
+package appmetrics
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RoomHeader is the metadata key a Chat client uses to name its room.
+const RoomHeader = "x-chat-room"
+
+// maxRooms is how many distinct rooms get their own series.
+const maxRooms = 20
+
+// Metrics holds the Greeter's application metrics.
+type Metrics struct {
+	greetings      *prometheus.CounterVec
+	activeStreams  *prometheus.GaugeVec
+	streamMessages *prometheus.HistogramVec
+
+	rooms *LabelGuard
+}
+
+// New creates the metrics and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		greetings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_greetings_total",
+			Help: "Greetings requested, by length of the name.",
+		}, []string{"name_length"}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "greeter_chat_active_streams",
+			Help: "Chat streams currently open, by room.",
+		}, []string{"room"}),
+		streamMessages: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "greeter_stream_messages_per_rpc",
+			Help:    "Messages sent or received over the lifetime of one streaming RPC.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"method", "direction"}),
+		rooms: NewLabelGuard(maxRooms),
+	}
+
+	reg.MustRegister(m.greetings, m.activeStreams, m.streamMessages)
+
+	// Export every bucket from the start, so rates work before the first
+	// greeting of a kind.
+	for _, bucket := range nameLengthBuckets {
+		m.greetings.WithLabelValues(bucket.label)
+	}
+	return m
+}
+
+var nameLengthBuckets = []struct {
+	max   int
+	label string
+}{
+	{0, "0"},
+	{4, "1-4"},
+	{9, "5-9"},
+	{19, "10-19"},
+	{-1, "20+"},
+}
+
+// nameLengthBucket maps a name to a fixed set of label values.
+func nameLengthBucket(name string) string {
+	n := len([]rune(name))
+	for _, b := range nameLengthBuckets {
+		if b.max < 0 || n <= b.max {
+			return b.label
+		}
+	}
+	return nameLengthBuckets[len(nameLengthBuckets)-1].label
+}
+
+// ObserveGreeting counts a greeting for name.
+func (m *Metrics) ObserveGreeting(name string) {
+	m.greetings.WithLabelValues(nameLengthBucket(name)).Inc()
+}
+
+// ChatStarted records an open Chat stream in the room named by the
+// x-chat-room header. Call the returned function when the stream ends.
+func (m *Metrics) ChatStarted(ctx context.Context) (done func()) {
+	room := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(RoomHeader); len(v) > 0 {
+			room = v[0]
+		}
+	}
+
+	gauge := m.activeStreams.WithLabelValues(m.rooms.Value(room))
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// StreamServerInterceptor counts the messages each streaming RPC sends and
+// receives and observes the totals when it ends.
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		counted := &countingStream{ServerStream: ss}
+		err := handler(srv, counted)
+
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		if info.IsServerStream {
+			m.streamMessages.WithLabelValues(method, "sent").Observe(float64(counted.sent))
+		}
+		if info.IsClientStream {
+			m.streamMessages.WithLabelValues(method, "received").Observe(float64(counted.received))
+		}
+		return err
+	}
+}
+
+// countingStream counts messages. Handlers use a stream from a single
+// goroutine per direction, so plain counters suffice.
+type countingStream struct {
+	grpc.ServerStream
+	sent, received int
+}
+
+func (s *countingStream) SendMsg(msg interface{}) error {
+	err := s.ServerStream.SendMsg(msg)
+	if err == nil {
+		s.sent++
+	}
+	return err
+}
+
+func (s *countingStream) RecvMsg(msg interface{}) error {
+	err := s.ServerStream.RecvMsg(msg)
+	if err == nil {
+		s.received++
+	}
+	return err
+}
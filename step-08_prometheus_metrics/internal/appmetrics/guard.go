@@ -0,0 +1,68 @@
+package appmetrics
+
+import (
+	"strings"
+	"sync"
+)
+
+// Values reported by a LabelGuard instead of the real one.
+const (
+	LabelNone  = "none"
+	LabelOther = "other"
+)
+
+// maxLabelLength is the longest label value a LabelGuard passes through.
+const maxLabelLength = 32
+
+// LabelGuard keeps a user-supplied label from creating unbounded series.
+// The first max distinct valid values are reported as-is, everything after
+// that as "other". A value keeps its mapping once seen, so gauges that are
+// incremented and decremented stay balanced.
+type LabelGuard struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewLabelGuard allows up to max distinct values.
+func NewLabelGuard(max int) *LabelGuard {
+	return &LabelGuard{max: max, seen: make(map[string]struct{}, max)}
+}
+
+// Value returns the label value to record for v. Empty values become
+// "none"; values that are too long or contain anything but lowercase
+// letters, digits, '-' and '_' become "other".
+func (g *LabelGuard) Value(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return LabelNone
+	}
+	if !validLabel(v) {
+		return LabelOther
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.seen[v]; ok {
+		return v
+	}
+	if len(g.seen) >= g.max {
+		return LabelOther
+	}
+	g.seen[v] = struct{}{}
+	return v
+}
+
+func validLabel(v string) bool {
+	if len(v) > maxLabelLength || v == LabelNone || v == LabelOther {
+		return false
+	}
+	for _, r := range v {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
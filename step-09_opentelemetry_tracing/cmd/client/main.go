@@ -2,20 +2,23 @@ package main
 
 import (
 	"context"
+	"flag"
+	"io"
 	"log"
+	"log/slog"
+	"os"
 	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
 	greeterpb "step-09_opentelemetry_tracing/internal/greeter"
+	"step-09_opentelemetry_tracing/internal/otelmetrics"
+	"step-09_opentelemetry_tracing/internal/tracelog"
+	"step-09_opentelemetry_tracing/internal/tracing"
 
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 )
@@ -24,31 +27,6 @@ const (
 	address = "localhost:50051"
 )
 
-// tracerProvider returns an OpenTelemetry TracerProvider configured to use
-// the OTLP HTTP exporter that will send spans to the provided url.
-func tracerProvider(serviceName string) (*sdktrace.TracerProvider, error) {
-	// Create the OTLP HTTP exporter
-	exp, err := otlptracehttp.New(
-		context.Background(),
-		otlptracehttp.WithEndpoint("localhost:14318"),
-		otlptracehttp.WithInsecure(),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(serviceName),
-			attribute.String("environment", "demo"),
-		)),
-	)
-
-	return tp, nil
-}
-
 func callSayHello(client greeterpb.GreeterClient, name string) {
 	// Create a root span
 	ctx, span := otel.Tracer("greeter-client").Start(context.Background(), "callSayHello")
@@ -62,16 +40,101 @@ func callSayHello(client greeterpb.GreeterClient, name string) {
 	if err != nil {
 		log.Fatalf("could not greet: %v", err)
 	}
-	log.Printf("Greeting: %s", r.GetMessage())
+	slog.InfoContext(ctx, "Greeting", "message", r.GetMessage())
+}
+
+func callStreamGreetings(client greeterpb.GreeterClient, name string) {
+	ctx, span := otel.Tracer("greeter-client").Start(context.Background(), "callStreamGreetings")
+	defer span.End()
+
+	stream, err := client.StreamGreetings(ctx, &greeterpb.HelloRequest{Name: name})
+	if err != nil {
+		log.Fatalf("could not stream greetings: %v", err)
+	}
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("error while streaming: %v", err)
+		}
+		slog.InfoContext(ctx, "Stream greeting", "message", r.GetMessage())
+	}
+}
+
+func callChat(client greeterpb.GreeterClient, messages []string) {
+	ctx, span := otel.Tracer("greeter-client").Start(context.Background(), "callChat")
+	defer span.End()
+
+	stream, err := client.Chat(ctx)
+	if err != nil {
+		log.Fatalf("could not chat: %v", err)
+	}
+	for _, msg := range messages {
+		if err := stream.Send(&greeterpb.HelloRequest{Name: msg}); err != nil {
+			log.Fatalf("failed to send: %v", err)
+		}
+		r, err := stream.Recv()
+		if err != nil {
+			log.Fatalf("failed to receive: %v", err)
+		}
+		slog.InfoContext(ctx, "Chat reply", "message", r.GetMessage())
+	}
+	if err := stream.CloseSend(); err != nil {
+		log.Fatalf("failed to close chat: %v", err)
+	}
+	// Wait for the server to end the stream
+	if _, err := stream.Recv(); err != io.EOF {
+		log.Fatalf("chat did not end cleanly: %v", err)
+	}
 }
 
 func main() {
+	metricsExporter := flag.String("metrics-exporter", otelmetrics.ExporterNone, "Where OpenTelemetry metrics go: otlp, stdout or none")
+	otlpMetricsEndpoint := flag.String("otlp-metrics-endpoint", "localhost:14317", "OTLP gRPC endpoint for -metrics-exporter=otlp")
+	traceExporter := flag.String("trace-exporter", tracing.ExporterOTLPHTTP, "Where spans go: otlphttp, otlpgrpc, stdout, file or none")
+	traceEndpoint := flag.String("trace-endpoint", "", "Collector host:port for the OTLP exporters (default localhost:14318 for otlphttp, localhost:14317 for otlpgrpc)")
+	traceFile := flag.String("trace-file", "traces.jsonl", "File for -trace-exporter=file, one JSON span per line")
+	traceSampler := flag.String("trace-sampler", tracing.SamplerParentBased, "Sampler: always, never, ratio or parentbased")
+	traceRatio := flag.Float64("trace-ratio", 1, "Fraction of root traces sampled by the ratio and parentbased samplers")
+	flag.Parse()
+
+	// Log records written within a span carry its trace and span IDs
+	slog.SetDefault(slog.New(tracelog.NewHandler(slog.NewTextHandler(os.Stderr, nil))))
+
+	// The client exits right after its calls, so nothing could scrape it
+	if *metricsExporter == otelmetrics.ExporterPrometheus {
+		log.Fatalf("-metrics-exporter=prometheus is not supported by the client, use otlp or stdout")
+	}
+
 	// Initialize tracer provider
-	tp, err := tracerProvider("greeter-client")
+	tp, err := tracing.NewTracerProvider(context.Background(), tracing.Config{
+		ServiceName: "greeter-client",
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		File:        *traceFile,
+		Sampler:     *traceSampler,
+		Ratio:       *traceRatio,
+	})
 	if err != nil {
 		log.Fatalf("Failed to create tracer provider: %v", err)
 	}
 
+	// Initialize the meter provider and record rpc.client.duration
+	mp, err := otelmetrics.NewMeterProvider(context.Background(), otelmetrics.Config{
+		Exporter:     *metricsExporter,
+		OTLPEndpoint: *otlpMetricsEndpoint,
+		Resource:     tracing.Resource("greeter-client"),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create meter provider: %v", err)
+	}
+	otelMetrics, err := otelmetrics.NewRPCMetrics(mp)
+	if err != nil {
+		log.Fatalf("Failed to create RPC metrics: %v", err)
+	}
+
 	// Register our TracerProvider as the global
 	otel.SetTracerProvider(tp)
 
@@ -85,8 +148,8 @@ func main() {
 	conn, err := grpc.Dial(
 		address,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
-		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), otelMetrics.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(), otelMetrics.StreamClientInterceptor()),
 	)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
@@ -99,6 +162,8 @@ func main() {
 	callSayHello(client, "world")
 	callSayHello(client, "gRPC")
 	callSayHello(client, "OpenTelemetry")
+	callStreamGreetings(client, "streams")
+	callChat(client, []string{"Hello", "How are you?", "Bye!"})
 
 	// Give some time for spans to be exported
 	time.Sleep(2 * time.Second)
@@ -107,4 +172,9 @@ func main() {
 	if err := tp.Shutdown(context.Background()); err != nil {
 		log.Fatalf("Error shutting down tracer provider: %v", err)
 	}
+
+	// Shut down the meter provider, flushing the last measurements
+	if err := mp.Shutdown(context.Background()); err != nil {
+		log.Fatalf("Error shutting down meter provider: %v", err)
+	}
 }
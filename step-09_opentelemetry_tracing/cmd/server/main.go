@@ -2,38 +2,49 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 
 	greeterpb "step-09_opentelemetry_tracing/internal/greeter"
+	"step-09_opentelemetry_tracing/internal/otelmetrics"
+	"step-09_opentelemetry_tracing/internal/rpcmetrics"
+	"step-09_opentelemetry_tracing/internal/streamtrace"
+	"step-09_opentelemetry_tracing/internal/tracelog"
+	"step-09_opentelemetry_tracing/internal/tracing"
 )
 
+const metricsAddr = ":9090"
+
 type server struct {
 	greeterpb.UnimplementedGreeterServer
 }
 
 func (s *server) SayHello(ctx context.Context, in *greeterpb.HelloRequest) (*greeterpb.HelloReply, error) {
 	// Get the current span from the context
-	_, span := otel.Tracer("greeter").Start(ctx, "SayHello")
+	ctx, span := otel.Tracer("greeter").Start(ctx, "SayHello")
 	defer span.End()
 
 	// Add attributes to the span
 	span.SetAttributes(attribute.String("request.name", in.Name))
+	slog.InfoContext(ctx, "Received SayHello request", "name", in.Name)
 
 	// Simulate some work
 	time.Sleep(100 * time.Millisecond)
@@ -41,34 +52,66 @@ func (s *server) SayHello(ctx context.Context, in *greeterpb.HelloRequest) (*gre
 	return &greeterpb.HelloReply{Message: "Hello " + in.Name}, nil
 }
 
-// tracerProvider returns an OpenTelemetry TracerProvider configured to use
-// the OTLP HTTP exporter that will send spans to the provided url.
-func tracerProvider(serviceName string) (*sdktrace.TracerProvider, error) {
-	// Create the OTLP HTTP exporter
-	exp, err := otlptracehttp.New(
-		context.Background(),
-		otlptracehttp.WithEndpoint("localhost:14318"),
-		otlptracehttp.WithInsecure(),
-	)
-	if err != nil {
-		return nil, err
+func (s *server) StreamGreetings(in *greeterpb.HelloRequest, stream greeterpb.Greeter_StreamGreetingsServer) error {
+	slog.InfoContext(stream.Context(), "Streaming greetings", "name", in.Name)
+	for i := 1; i <= 5; i++ {
+		if err := stream.Send(&greeterpb.HelloReply{
+			Message: fmt.Sprintf("Hello %s #%d", in.Name, i),
+		}); err != nil {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
 	}
+	return nil
+}
 
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(serviceName),
-			attribute.String("environment", "demo"),
-		)),
-	)
+func (s *server) Chat(stream greeterpb.Greeter_ChatServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// With -stream-message-spans, this span is a child of the span
+		// of the message being processed
+		ctx, span := otel.Tracer("greeter").Start(stream.Context(), "compose reply")
+		slog.InfoContext(ctx, "Received chat message", "message", in.Name)
+		time.Sleep(50 * time.Millisecond)
+		span.End()
 
-	return tp, nil
+		if err := stream.Send(&greeterpb.HelloReply{Message: "You said: " + in.Name}); err != nil {
+			return err
+		}
+	}
 }
 
 func main() {
+	metricsExporter := flag.String("metrics-exporter", otelmetrics.ExporterPrometheus, "Where OpenTelemetry metrics go: prometheus, otlp, stdout or none")
+	otlpMetricsEndpoint := flag.String("otlp-metrics-endpoint", "localhost:14317", "OTLP gRPC endpoint for -metrics-exporter=otlp")
+	traceExporter := flag.String("trace-exporter", tracing.ExporterOTLPHTTP, "Where spans go: otlphttp, otlpgrpc, stdout, file or none")
+	traceEndpoint := flag.String("trace-endpoint", "", "Collector host:port for the OTLP exporters (default localhost:14318 for otlphttp, localhost:14317 for otlpgrpc)")
+	traceFile := flag.String("trace-file", "traces.jsonl", "File for -trace-exporter=file, one JSON span per line")
+	traceSampler := flag.String("trace-sampler", tracing.SamplerParentBased, "Sampler: always, never, ratio or parentbased")
+	traceRatio := flag.Float64("trace-ratio", 1, "Fraction of root traces sampled by the ratio and parentbased samplers")
+	streamMaxEvents := flag.Int("stream-max-events", streamtrace.DefaultMaxEvents, "Maximum message events recorded on a streaming RPC's span")
+	streamMessageSpans := flag.Bool("stream-message-spans", false, "Start a child span for every message received on a stream")
+	flag.Parse()
+
+	// Log records written within a span carry its trace and span IDs
+	slog.SetDefault(slog.New(tracelog.NewHandler(slog.NewTextHandler(os.Stderr, nil))))
+
 	// Initialize tracer provider
-	tp, err := tracerProvider("greeter-service")
+	tp, err := tracing.NewTracerProvider(context.Background(), tracing.Config{
+		ServiceName: "greeter-service",
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		File:        *traceFile,
+		Sampler:     *traceSampler,
+		Ratio:       *traceRatio,
+	})
 	if err != nil {
 		log.Fatalf("Failed to create tracer provider: %v", err)
 	}
@@ -82,10 +125,72 @@ func main() {
 		propagation.Baggage{},
 	))
 
-	// Set up gRPC server with OpenTelemetry interceptors
+	// The interceptors come in order: tracing first, so the span exists
+	// when the metrics interceptors look for its trace ID.
+	unary := []grpc.UnaryServerInterceptor{otelgrpc.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{
+		// Replaces otelgrpc for streams, adding capped per-message events
+		streamtrace.StreamServerInterceptor(streamtrace.Options{
+			MaxEvents:    *streamMaxEvents,
+			MessageSpans: *streamMessageSpans,
+		}),
+	}
+
+	// With the Prometheus exporter, the RPC metrics are served on
+	// metricsAddr too. Their latency histograms carry the trace ID of
+	// sampled calls as exemplars. The other exporters push or drop
+	// everything, so nothing would ever scrape them.
+	var reg *prometheus.Registry
+	var metricsServer *http.Server
+	if *metricsExporter == otelmetrics.ExporterPrometheus {
+		reg = prometheus.NewRegistry()
+		rpcMetrics := rpcmetrics.NewServerMetrics(nil)
+		reg.MustRegister(rpcMetrics)
+		unary = append(unary, rpcMetrics.UnaryServerInterceptor())
+		stream = append(stream, rpcMetrics.StreamServerInterceptor())
+	}
+
+	// Initialize the OpenTelemetry meter provider. The Prometheus exporter
+	// shares the registry, so everything is served on one endpoint.
+	mp, err := otelmetrics.NewMeterProvider(context.Background(), otelmetrics.Config{
+		Exporter:     *metricsExporter,
+		OTLPEndpoint: *otlpMetricsEndpoint,
+		Registerer:   reg,
+		Resource:     tracing.Resource("greeter-service"),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create meter provider: %v", err)
+	}
+
+	// Record rpc.server.duration through OpenTelemetry
+	otelMetrics, err := otelmetrics.NewRPCMetrics(mp)
+	if err != nil {
+		log.Fatalf("Failed to create RPC metrics: %v", err)
+	}
+	unary = append(unary, otelMetrics.UnaryServerInterceptor())
+	stream = append(stream, otelMetrics.StreamServerInterceptor())
+
+	if reg != nil {
+		// Serve the metrics in the OpenMetrics format, the only one that
+		// carries exemplars
+		metricsServer = &http.Server{
+			Addr: metricsAddr,
+			Handler: promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+				EnableOpenMetrics: true,
+			}),
+		}
+		go func() {
+			log.Printf("Metrics available at http://localhost%s/metrics", metricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start metrics server: %v", err)
+			}
+		}()
+	}
+
+	// Set up gRPC server with OpenTelemetry and metrics interceptors
 	s := grpc.NewServer(
-		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
-		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
 	)
 
 	// Register the Greeter server
@@ -119,11 +224,19 @@ func main() {
 
 	// Gracefully stop the server
 	s.GracefulStop()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
 
 	// Shut down the tracer provider
 	if err := tp.Shutdown(context.Background()); err != nil {
 		log.Fatalf("Error shutting down tracer provider: %v", err)
 	}
 
+	// Shut down the meter provider, flushing push exporters
+	if err := mp.Shutdown(context.Background()); err != nil {
+		log.Fatalf("Error shutting down meter provider: %v", err)
+	}
+
 	log.Println("Server stopped")
 }
@@ -0,0 +1,98 @@
+// Package otelmetrics emits RPC metrics through the OpenTelemetry metrics
+// SDK, following the rpc.server.duration and rpc.client.duration semantic
+// conventions. Where the metrics go is a matter of configuration:
+// Prometheus pull, OTLP push, stdout, or nowhere.
+package otelmetrics
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// Supported exporters.
+const (
+	ExporterPrometheus = "prometheus"
+	ExporterOTLP       = "otlp"
+	ExporterStdout     = "stdout"
+	ExporterNone       = "none"
+)
+
+// DefaultInterval is how often push exporters send metrics.
+const DefaultInterval = 10 * time.Second
+
+// Config selects and configures the exporter.
+type Config struct {
+	// Exporter is one of the Exporter constants.
+	Exporter string
+	// OTLPEndpoint is the host:port of an OTLP gRPC receiver.
+	OTLPEndpoint string
+	// Interval between pushes for the OTLP and stdout exporters.
+	// Defaults to DefaultInterval.
+	Interval time.Duration
+	// Registerer receives the metrics of the Prometheus exporter, to be
+	// served by the caller. Defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+	// Resource describes the process, e.g. its service.name.
+	Resource *resource.Resource
+}
+
+// NewMeterProvider returns a meter provider exporting as configured. With
+// ExporterNone, measurements are accepted and dropped. Shut the provider
+// down before exiting, so push exporters flush the last measurements.
+func NewMeterProvider(ctx context.Context, cfg Config) (*sdkmetric.MeterProvider, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+
+	opts := []sdkmetric.Option{}
+	if cfg.Resource != nil {
+		opts = append(opts, sdkmetric.WithResource(cfg.Resource))
+	}
+
+	switch cfg.Exporter {
+	case ExporterPrometheus:
+		reg := cfg.Registerer
+		if reg == nil {
+			reg = prometheus.DefaultRegisterer
+		}
+		exp, err := otelprom.New(otelprom.WithRegisterer(reg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Prometheus exporter: %v", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(exp))
+
+	case ExporterOTLP:
+		exp, err := otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithEndpoint(cfg.OTLPEndpoint),
+			otlpmetricgrpc.WithInsecure(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(cfg.Interval))))
+
+	case ExporterStdout:
+		exp, err := stdoutmetric.New(stdoutmetric.WithWriter(os.Stdout), stdoutmetric.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %v", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(cfg.Interval))))
+
+	case ExporterNone, "":
+
+	default:
+		return nil, fmt.Errorf("unknown metrics exporter %q, want %s, %s, %s or %s",
+			cfg.Exporter, ExporterPrometheus, ExporterOTLP, ExporterStdout, ExporterNone)
+	}
+
+	return sdkmetric.NewMeterProvider(opts...), nil
+}
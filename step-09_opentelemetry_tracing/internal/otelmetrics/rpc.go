@@ -0,0 +1,181 @@
+package otelmetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// instrumentationName identifies the meter of this package.
+const instrumentationName = "step-09_opentelemetry_tracing/internal/otelmetrics"
+
+// durationBuckets are the boundaries, in milliseconds, recommended by the
+// RPC semantic conventions.
+var durationBuckets = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+// RPCMetrics records the duration of gRPC calls.
+type RPCMetrics struct {
+	serverDuration metric.Float64Histogram
+	clientDuration metric.Float64Histogram
+}
+
+// NewRPCMetrics creates the instruments on mp.
+//
+// otelgrpc records rpc.server.duration as well, but only for unary calls and
+// only on the global meter provider. Leaving the global provider unset keeps
+// the two from reporting the same instrument.
+func NewRPCMetrics(mp metric.MeterProvider) (*RPCMetrics, error) {
+	meter := mp.Meter(instrumentationName)
+
+	serverDuration, err := meter.Float64Histogram("rpc.server.duration",
+		metric.WithDescription("Measures the duration of inbound RPC."),
+		metric.WithUnit("ms"),
+		metric.WithExplicitBucketBoundaries(durationBuckets...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDuration, err := meter.Float64Histogram("rpc.client.duration",
+		metric.WithDescription("Measures the duration of outbound RPC."),
+		metric.WithUnit("ms"),
+		metric.WithExplicitBucketBoundaries(durationBuckets...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RPCMetrics{serverDuration: serverDuration, clientDuration: clientDuration}, nil
+}
+
+// UnaryServerInterceptor records rpc.server.duration for unary calls.
+func (m *RPCMetrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		record(ctx, m.serverDuration, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records rpc.server.duration for streaming calls.
+func (m *RPCMetrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		record(ss.Context(), m.serverDuration, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// UnaryClientInterceptor records rpc.client.duration for unary calls.
+func (m *RPCMetrics) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		record(ctx, m.clientDuration, method, start, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor records rpc.client.duration for streaming calls.
+// A stream ends when receiving from it fails, io.EOF included, when the
+// response of a call without server streaming arrives, or when its context
+// is done, e.g. after the caller cancels it or stops reading.
+func (m *RPCMetrics) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			record(ctx, m.clientDuration, method, start, err)
+			return nil, err
+		}
+
+		s := &clientStream{ClientStream: cs, desc: desc, finish: func(err error) {
+			record(ctx, m.clientDuration, method, start, err)
+		}}
+		go s.watch()
+		return s, nil
+	}
+}
+
+// clientStream reports the end of a stream exactly once.
+type clientStream struct {
+	grpc.ClientStream
+	desc   *grpc.StreamDesc
+	finish func(error)
+	once   sync.Once
+
+	// mu is held while receiving, so the end of a stream seen by RecvMsg
+	// is reported with its status rather than as a done context
+	mu sync.Mutex
+}
+
+func (s *clientStream) end(err error) {
+	s.once.Do(func() {
+		// io.EOF is the normal end of a stream.
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		s.finish(err)
+	})
+}
+
+// watch reports streams that end without RecvMsg seeing it. gRPC cancels
+// the context of a stream once it is over, whatever the reason.
+func (s *clientStream) watch() {
+	ctx := s.Context()
+	<-ctx.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end(status.FromContextError(ctx.Err()).Err())
+}
+
+func (s *clientStream) SendMsg(msg interface{}) error {
+	err := s.ClientStream.SendMsg(msg)
+	// io.EOF means the stream is over; RecvMsg returns its status
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.end(err)
+	}
+	return err
+}
+
+func (s *clientStream) RecvMsg(msg interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.ClientStream.RecvMsg(msg)
+	// Without server streaming, the one response ends the stream
+	if err != nil || !s.desc.ServerStreams {
+		s.end(err)
+	}
+	return err
+}
+
+func record(ctx context.Context, h metric.Float64Histogram, fullMethod string, start time.Time, err error) {
+	service, method := splitMethodName(fullMethod)
+	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+
+	h.Record(ctx, elapsed, metric.WithAttributes(
+		semconv.RPCSystemGRPC,
+		semconv.RPCService(service),
+		semconv.RPCMethod(method),
+		semconv.RPCGRPCStatusCodeKey.Int(int(status.Code(err))),
+	))
+}
+
+// splitMethodName splits "/package.Service/Method" into its parts.
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
@@ -0,0 +1,152 @@
+// Package rpcmetrics records Prometheus metrics for gRPC servers in the
+// go-grpc-prometheus format, with one addition: when a call runs inside a
+// sampled OpenTelemetry span, its observations carry the trace ID as an
+// exemplar. Served in the OpenMetrics format, this lets Grafana jump from a
+// slow latency bucket straight to a trace of a call that landed in it.
+//
+// The interceptors read the span from the context, so they must run after
+// the otelgrpc interceptors, i.e. come later in the chain.
+package rpcmetrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Values of the grpc_type label.
+const (
+	Unary        = "unary"
+	ClientStream = "client_stream"
+	ServerStream = "server_stream"
+	BidiStream   = "bidi_stream"
+)
+
+// DefaultBuckets are the handling time buckets, in seconds.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ServerMetrics is a prometheus.Collector for gRPC server calls.
+type ServerMetrics struct {
+	started         *prometheus.CounterVec
+	handled         *prometheus.CounterVec
+	handlingSeconds *prometheus.HistogramVec
+}
+
+// NewServerMetrics returns server metrics using buckets for the handling
+// time histogram, or DefaultBuckets if buckets is nil.
+func NewServerMetrics(buckets []float64) *ServerMetrics {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	return &ServerMetrics{
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_started_total",
+			Help: "Total number of RPCs started on the server.",
+		}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "Total number of RPCs completed on the server, regardless of success or failure.",
+		}, []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}),
+		handlingSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of gRPC that had been application-level handled by the server.",
+			Buckets: buckets,
+		}, []string{"grpc_type", "grpc_service", "grpc_method"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *ServerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.started.Describe(ch)
+	m.handled.Describe(ch)
+	m.handlingSeconds.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *ServerMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.started.Collect(ch)
+	m.handled.Collect(ch)
+	m.handlingSeconds.Collect(ch)
+}
+
+// UnaryServerInterceptor records unary calls.
+func (m *ServerMetrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := m.start(Unary, info.FullMethod)
+		resp, err := handler(ctx, req)
+		m.done(ctx, Unary, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records streaming calls.
+func (m *ServerMetrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		typ := streamType(info)
+		start := m.start(typ, info.FullMethod)
+		err := handler(srv, ss)
+		m.done(ss.Context(), typ, info.FullMethod, start, err)
+		return err
+	}
+}
+
+func (m *ServerMetrics) start(typ, fullMethod string) time.Time {
+	service, method := splitMethodName(fullMethod)
+	m.started.WithLabelValues(typ, service, method).Inc()
+	return time.Now()
+}
+
+func (m *ServerMetrics) done(ctx context.Context, typ, fullMethod string, start time.Time, err error) {
+	service, method := splitMethodName(fullMethod)
+	code := status.Code(err).String()
+	exemplar := traceExemplar(ctx)
+
+	handled := m.handled.WithLabelValues(typ, service, method, code)
+	latency := m.handlingSeconds.WithLabelValues(typ, service, method)
+	elapsed := time.Since(start).Seconds()
+
+	if exemplar == nil {
+		handled.Inc()
+		latency.Observe(elapsed)
+		return
+	}
+	handled.(prometheus.ExemplarAdder).AddWithExemplar(1, exemplar)
+	latency.(prometheus.ExemplarObserver).ObserveWithExemplar(elapsed, exemplar)
+}
+
+// traceExemplar returns the exemplar labels for the span in ctx, or nil if
+// there is no sampled span. Unsampled traces are never exported, so linking
+// to them would lead nowhere.
+func traceExemplar(ctx context.Context) prometheus.Labels {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() || !sc.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": sc.TraceID().String()}
+}
+
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return BidiStream
+	case info.IsClientStream:
+		return ClientStream
+	default:
+		return ServerStream
+	}
+}
+
+// splitMethodName splits "/package.Service/Method" into its parts.
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
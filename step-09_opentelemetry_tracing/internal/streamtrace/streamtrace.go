@@ -0,0 +1,218 @@
+// Package streamtrace traces streaming RPCs message by message. otelgrpc
+// gives a stream one span whose message events carry neither size nor
+// limit; this package creates the server span itself and records an event
+// per message with its sequence number and size. Events per span are
+// capped so long chats cannot produce unbounded spans, and each received
+// message can optionally get a child span covering its processing.
+//
+// Use StreamServerInterceptor instead of otelgrpc.StreamServerInterceptor,
+// first in the chain, so later interceptors see the span.
+package streamtrace
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// instrumentationName identifies the tracer of this package.
+const instrumentationName = "step-09_opentelemetry_tracing/internal/streamtrace"
+
+// DefaultMaxEvents is the default cap on message events per span.
+const DefaultMaxEvents = 64
+
+// EventsDroppedKey counts the message events left out because of the cap.
+const EventsDroppedKey = attribute.Key("rpc.message.events_dropped")
+
+// Options tune the tracing of streams.
+type Options struct {
+	// MaxEvents caps the message events recorded on a stream span.
+	// Defaults to DefaultMaxEvents.
+	MaxEvents int
+	// MessageSpans starts a child span for every received message. It
+	// lasts until the handler receives the next message or returns, and
+	// is the span of the stream's Context() meanwhile, so work done for
+	// the message is attributed to it.
+	MessageSpans bool
+}
+
+// StreamServerInterceptor starts a server span for each streaming RPC,
+// continuing the trace propagated by the client.
+func StreamServerInterceptor(opts Options) grpc.StreamServerInterceptor {
+	if opts.MaxEvents <= 0 {
+		opts.MaxEvents = DefaultMaxEvents
+	}
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+
+		service, method := splitMethodName(info.FullMethod)
+		tracer := otel.Tracer(instrumentationName)
+		ctx, span := tracer.Start(ctx, strings.TrimPrefix(info.FullMethod, "/"),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.RPCSystemGRPC,
+				semconv.RPCService(service),
+				semconv.RPCMethod(method),
+			),
+		)
+
+		stream := &tracedStream{
+			ServerStream: ss,
+			opts:         opts,
+			tracer:       tracer,
+			name:         method,
+			ctx:          ctx,
+			span:         span,
+		}
+		err := handler(srv, stream)
+		stream.endMessageSpan()
+
+		code := status.Code(err)
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+		if err != nil {
+			span.SetStatus(codes.Error, status.Convert(err).Message())
+		}
+		if dropped := stream.droppedEvents(); dropped > 0 {
+			span.SetAttributes(EventsDroppedKey.Int(dropped))
+		}
+		span.End()
+		return err
+	}
+}
+
+// tracedStream records message events. Sending and receiving may happen on
+// different goroutines, hence the mutex.
+type tracedStream struct {
+	grpc.ServerStream
+	opts   Options
+	tracer trace.Tracer
+	name   string
+	ctx    context.Context
+	span   trace.Span
+
+	mu          sync.Mutex
+	sent        int
+	received    int
+	events      int
+	dropped     int
+	messageCtx  context.Context
+	messageSpan trace.Span
+}
+
+// Context returns the stream context, or the context of the current
+// message span when MessageSpans is on.
+func (s *tracedStream) Context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.messageCtx != nil {
+		return s.messageCtx
+	}
+	return s.ctx
+}
+
+func (s *tracedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.mu.Lock()
+		s.sent++
+		s.addEventLocked(semconv.RPCMessageTypeSent, s.sent, m)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *tracedStream) RecvMsg(m interface{}) error {
+	// Processing of the previous message ends when the handler asks for
+	// the next one.
+	s.endMessageSpan()
+
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received++
+	s.addEventLocked(semconv.RPCMessageTypeReceived, s.received, m)
+
+	if s.opts.MessageSpans {
+		s.messageCtx, s.messageSpan = s.tracer.Start(s.ctx, s.name+" message",
+			trace.WithAttributes(semconv.RPCMessageID(s.received)),
+		)
+	}
+	return nil
+}
+
+func (s *tracedStream) addEventLocked(typ attribute.KeyValue, seq int, m interface{}) {
+	if s.events >= s.opts.MaxEvents {
+		s.dropped++
+		return
+	}
+	s.events++
+
+	attrs := []attribute.KeyValue{typ, semconv.RPCMessageID(seq)}
+	if msg, ok := m.(proto.Message); ok {
+		attrs = append(attrs, semconv.RPCMessageUncompressedSizeKey.Int(proto.Size(msg)))
+	}
+	s.span.AddEvent("message", trace.WithAttributes(attrs...))
+}
+
+func (s *tracedStream) endMessageSpan() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.messageSpan != nil {
+		s.messageSpan.End()
+		s.messageSpan, s.messageCtx = nil, nil
+	}
+}
+
+func (s *tracedStream) droppedEvents() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// metadataCarrier lets propagators read gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// splitMethodName splits "/package.Service/Method" into its parts.
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", "unknown"
+}
@@ -0,0 +1,180 @@
+// Package tracing builds the OpenTelemetry tracer provider shared by the
+// server and the client. The exporter and the sampler are chosen by
+// configuration, so traces can go to a collector, to stdout or to a
+// JSON-lines file when no collector is around, e.g. in CI.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// Supported exporters.
+const (
+	ExporterOTLPHTTP = "otlphttp"
+	ExporterOTLPGRPC = "otlpgrpc"
+	ExporterStdout   = "stdout"
+	ExporterFile     = "file"
+	ExporterNone     = "none"
+)
+
+// Supported samplers.
+const (
+	SamplerAlways      = "always"
+	SamplerNever       = "never"
+	SamplerRatio       = "ratio"
+	SamplerParentBased = "parentbased"
+)
+
+// Default collector endpoints of the docker-compose setup.
+const (
+	DefaultOTLPHTTPEndpoint = "localhost:14318"
+	DefaultOTLPGRPCEndpoint = "localhost:14317"
+)
+
+// Config selects the exporter and the sampler.
+type Config struct {
+	ServiceName string
+
+	// Exporter is one of the Exporter constants.
+	Exporter string
+	// Endpoint is the host:port of the collector for the OTLP exporters.
+	// Defaults to the endpoint matching the exporter.
+	Endpoint string
+	// File receives one JSON span per line for ExporterFile.
+	File string
+
+	// Sampler is one of the Sampler constants.
+	Sampler string
+	// Ratio of traces kept by SamplerRatio and SamplerParentBased.
+	Ratio float64
+}
+
+// Resource describes a service of this demo.
+func Resource(serviceName string) *resource.Resource {
+	return resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(serviceName),
+		attribute.String("environment", "demo"),
+	)
+}
+
+// NewTracerProvider returns a tracer provider exporting as configured.
+// Shut it down before exiting to flush the remaining spans.
+func NewTracerProvider(ctx context.Context, cfg Config) (*sdktrace.TracerProvider, error) {
+	sampler, err := newSampler(cfg.Sampler, cfg.Ratio)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(Resource(cfg.ServiceName)),
+	}
+
+	exp, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if exp != nil {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+func newExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case ExporterOTLPHTTP:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultOTLPHTTPEndpoint
+		}
+		return otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpoint(endpoint),
+			otlptracehttp.WithInsecure(),
+		)
+
+	case ExporterOTLPGRPC:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultOTLPGRPCEndpoint
+		}
+		return otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpoint(endpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("the file trace exporter needs a file name")
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		// Without pretty printing every span is written as one line.
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileExporter{SpanExporter: exp, file: f}, nil
+
+	case ExporterNone:
+		// Spans are still created and sampled, so trace IDs propagate and
+		// show up in logs and exemplars, but nothing is exported.
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want %s, %s, %s, %s or %s",
+			cfg.Exporter, ExporterOTLPHTTP, ExporterOTLPGRPC, ExporterStdout, ExporterFile, ExporterNone)
+	}
+}
+
+func newSampler(name string, ratio float64) (sdktrace.Sampler, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("sampling ratio %v is not between 0 and 1", ratio)
+	}
+
+	switch name {
+	case SamplerAlways:
+		return sdktrace.AlwaysSample(), nil
+	case SamplerNever:
+		return sdktrace.NeverSample(), nil
+	case SamplerRatio:
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case SamplerParentBased, "":
+		// Follow the caller's decision, and sample by ratio at the root.
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	default:
+		return nil, fmt.Errorf("unknown sampler %q, want %s, %s, %s or %s",
+			name, SamplerAlways, SamplerNever, SamplerRatio, SamplerParentBased)
+	}
+}
+
+// fileExporter closes the trace file once the exporter is shut down.
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if cerr := e.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
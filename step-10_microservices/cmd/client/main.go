@@ -2,19 +2,85 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"log/slog"
 	"os"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
+	loggerpb "step-10_microservices/internal/logger"
 	serverpb "step-10_microservices/internal/server"
+	"step-10_microservices/internal/tracelog"
+	"step-10_microservices/internal/tracing"
 )
 
+// showLogs prints the entries the Logger stored for the trace.
+func showLogs(addr, traceID string) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("did not connect to logger: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := loggerpb.NewLoggerClient(conn).Query(ctx, &loggerpb.QueryRequest{TraceId: traceID})
+	if err != nil {
+		log.Fatalf("could not query logs: %v", err)
+	}
+	slog.Info("Log entries of the trace", "count", len(resp.GetEntries()), tracelog.TraceIDKey, traceID)
+	for _, e := range resp.GetEntries() {
+		slog.Info("  "+e.GetMessage(),
+			"logged_at", time.Unix(0, e.GetTimestampUnixNano()),
+			"service", e.GetService(),
+			"level", e.GetLevel(),
+			"message_id", e.GetMessageId(),
+			tracelog.SpanIDKey, e.GetSpanId(),
+		)
+	}
+}
+
 func main() {
+	traceExporter := flag.String("trace-exporter", tracing.ExporterOTLPHTTP, "Where spans go: otlphttp, stdout, file or none")
+	traceEndpoint := flag.String("trace-endpoint", tracing.DefaultOTLPHTTPEndpoint, "Collector host:port for -trace-exporter=otlphttp")
+	traceFile := flag.String("trace-file", "client-traces.jsonl", "File for -trace-exporter=file, one JSON span per line")
+	logs := flag.Bool("show-logs", false, "Query the Logger for the log entries of the request's trace")
+	loggerAddr := flag.String("logger-addr", "localhost:50052", "Address of the Logger service for -show-logs")
+	timeout := flag.Duration("timeout", time.Second, "Deadline of the call")
+	flag.Parse()
+
+	// Structured logs carry the IDs of the active span
+	slog.SetDefault(slog.New(tracelog.NewHandler(slog.NewTextHandler(os.Stderr, nil))))
+
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		ServiceName: "client",
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		File:        *traceFile,
+	})
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+	defer func() {
+		// Flush the spans before exiting
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Printf("failed to shut down tracing: %v", err)
+		}
+	}()
+
 	// Set up a connection to the server
-	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial("localhost:50051",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
@@ -24,16 +90,27 @@ func main() {
 
 	// Contact the server and print out its response
 	name := "world"
-	if len(os.Args) > 1 {
-		name = os.Args[1]
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 
+	// The root span of the trace shared by the client, the Server and the
+	// Logger
+	ctx, span := otel.Tracer("client").Start(ctx, "greet")
+	span.SetAttributes(attribute.String("greet.name", name))
+	defer span.End()
+
 	r, err := client.SayHello(ctx, &serverpb.HelloRequest{Name: name})
 	if err != nil {
 		log.Fatalf("could not greet: %v", err)
 	}
-	log.Printf("Response: %s", r.GetMessage())
+	slog.InfoContext(ctx, "Response", "message", r.GetMessage())
+
+	if *logs {
+		traceID, _ := tracelog.IDs(ctx)
+		showLogs(*loggerAddr, traceID)
+	}
 }
@@ -2,41 +2,129 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 
+	"step-10_microservices/internal/budget"
 	loggerpb "step-10_microservices/internal/logger"
+	"step-10_microservices/internal/logstore"
+	"step-10_microservices/internal/tracelog"
+	"step-10_microservices/internal/tracing"
 )
 
 type server struct {
 	loggerpb.UnimplementedLoggerServer
+	store *logstore.Store
 }
 
 func (s *server) Log(ctx context.Context, req *loggerpb.LogRequest) (*loggerpb.LogResponse, error) {
-	log.Printf("[%s] %s: %s", req.GetLevel(), req.GetService(), req.GetMessage())
+	// Entries name the span of the service that logged them. Callers that
+	// predate the trace fields are still attributed to the trace they
+	// propagated.
+	traceID, spanID := req.GetTraceId(), req.GetSpanId()
+	if traceID == "" {
+		traceID, spanID = tracelog.IDs(ctx)
+	}
+
+	e := s.store.Add(logstore.Entry{
+		Service: req.GetService(),
+		Level:   req.GetLevel(),
+		Message: req.GetMessage(),
+		TraceID: traceID,
+		SpanID:  spanID,
+	})
+
+	attrs := []any{"service", e.Service, "level", e.Level, "message_id", e.ID}
+	if traceID != "" {
+		attrs = append(attrs, tracelog.TraceIDKey, traceID, tracelog.SpanIDKey, spanID)
+	}
+	if hops := budget.Hops(ctx); len(hops) > 0 {
+		attrs = append(attrs, "deadline_budget", hops)
+	}
+	slog.InfoContext(ctx, e.Message, attrs...)
+
 	return &loggerpb.LogResponse{
 		Success:   true,
-		MessageId: "log-" + req.GetService() + "-" + req.GetLevel(),
+		MessageId: e.ID,
 	}, nil
 }
 
+func (s *server) Query(ctx context.Context, req *loggerpb.QueryRequest) (*loggerpb.QueryResponse, error) {
+	resp := &loggerpb.QueryResponse{}
+	for _, e := range s.store.Query(req.GetTraceId(), int(req.GetLimit())) {
+		resp.Entries = append(resp.Entries, &loggerpb.LogEntry{
+			MessageId:         e.ID,
+			TimestampUnixNano: e.Time.UnixNano(),
+			Message:           e.Message,
+			Service:           e.Service,
+			Level:             e.Level,
+			TraceId:           e.TraceID,
+			SpanId:            e.SpanID,
+		})
+	}
+	return resp, nil
+}
+
 func main() {
+	traceExporter := flag.String("trace-exporter", tracing.ExporterOTLPHTTP, "Where spans go: otlphttp, stdout, file or none")
+	traceEndpoint := flag.String("trace-endpoint", tracing.DefaultOTLPHTTPEndpoint, "Collector host:port for -trace-exporter=otlphttp")
+	traceFile := flag.String("trace-file", "logger-traces.jsonl", "File for -trace-exporter=file, one JSON span per line")
+	capacity := flag.Int("capacity", logstore.DefaultCapacity, "Number of log entries kept in memory for Query")
+	flag.Parse()
+
+	// Structured logs carry the IDs of the active span
+	slog.SetDefault(slog.New(tracelog.NewHandler(slog.NewTextHandler(os.Stderr, nil))))
+
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		ServiceName: "logger",
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		File:        *traceFile,
+	})
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+
 	lis, err := net.Listen("tcp", ":50052")
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
-	loggerpb.RegisterLoggerServer(s, &server{})
+	// Continue the trace propagated by the caller
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
+	)
+	loggerpb.RegisterLoggerServer(s, &server{store: logstore.New(*capacity)})
 	
 	// Enable reflection for testing with grpcurl
 	reflection.Register(s)
-	
-	log.Println("Logger service listening on :50052")
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		log.Println("Logger service listening on :50052")
+		if err := s.Serve(lis); err != nil {
+			log.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	<-stopCh
+	log.Println("Shutting down logger service...")
+	s.GracefulStop()
+
+	// Flush the remaining spans
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Printf("failed to shut down tracing: %v", err)
 	}
 }
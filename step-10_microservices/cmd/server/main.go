@@ -2,14 +2,25 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/reflection"
 
+	"step-10_microservices/internal/budget"
 	loggerpb "step-10_microservices/internal/logger"
 	serverpb "step-10_microservices/internal/server"
+	"step-10_microservices/internal/tracelog"
+	"step-10_microservices/internal/tracing"
 )
 
 type server struct {
@@ -19,18 +30,23 @@ type server struct {
 
 func (s *server) SayHello(ctx context.Context, req *serverpb.HelloRequest) (*serverpb.HelloReply, error) {
 	// Debug log the incoming request
-	log.Printf("Received SayHello request with name: %q", req.GetName())
+	slog.DebugContext(ctx, "Received SayHello request", "name", req.GetName())
 	
-	// Log the request using the Logger service
-	_, err := s.loggerClient.Log(context.Background(), &loggerpb.LogRequest{
+	// Log the request using the Logger service. Passing the incoming
+	// context carries the trace, the deadline and cancellation over to the
+	// Logger call.
+	traceID, spanID := tracelog.IDs(ctx)
+	_, err := s.loggerClient.Log(ctx, &loggerpb.LogRequest{
 		Message: "Received hello request for: " + req.GetName(),
 		Service: "server",
 		Level:   "INFO",
+		TraceId: traceID,
+		SpanId:  spanID,
 	})
 	if err != nil {
-		log.Printf("Failed to log: %v", err)
+		slog.WarnContext(ctx, "Failed to log", "error", err)
 	}
-	log.Printf("Received message from client: %s", req.GetName())
+	slog.InfoContext(ctx, "Received message from client", "name", req.GetName())
 
 	return &serverpb.HelloReply{
 		Message: "Hello, " + req.GetName() + "!",
@@ -38,8 +54,55 @@ func (s *server) SayHello(ctx context.Context, req *serverpb.HelloRequest) (*ser
 }
 
 func main() {
-	// Set up a connection to the Logger service
-	conn, err := grpc.Dial("localhost:50052", grpc.WithInsecure())
+	traceExporter := flag.String("trace-exporter", tracing.ExporterOTLPHTTP, "Where spans go: otlphttp, stdout, file or none")
+	traceEndpoint := flag.String("trace-endpoint", tracing.DefaultOTLPHTTPEndpoint, "Collector host:port for -trace-exporter=otlphttp")
+	traceFile := flag.String("trace-file", "server-traces.jsonl", "File for -trace-exporter=file, one JSON span per line")
+	debug := flag.Bool("debug", false, "Log at debug level")
+	reserve := flag.Duration("budget-reserve", budget.DefaultReserve, "Time kept for the Server after calling the Logger")
+	minimum := flag.Duration("budget-min", budget.DefaultMinimum, "Shortest deadline worth sending to the Logger; less fails fast")
+	defaultBudget := flag.Duration("budget-default", time.Second, "Budget of requests that arrive without a deadline")
+	flag.Parse()
+
+	// Structured logs carry the IDs of the active span
+	level := slog.LevelInfo
+	if *debug {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(tracelog.NewHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))))
+
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		ServiceName: "server",
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		File:        *traceFile,
+	})
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	// Calls to the Logger get the remaining budget of the request minus a
+	// reserve for building the Server's own response
+	deadlines := budget.New(budget.Config{
+		Service: "server",
+		Reserve: *reserve,
+		Minimum: *minimum,
+		Default: *defaultBudget,
+	})
+
+	// Set up a connection to the Logger service. The otelgrpc interceptors
+	// inject the current span into the outgoing metadata, and come first so
+	// calls failing fast for lack of budget show up in the trace.
+	conn, err := grpc.Dial("localhost:50052",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(
+			otelgrpc.UnaryClientInterceptor(),
+			deadlines.UnaryClientInterceptor(),
+		),
+		grpc.WithChainStreamInterceptor(
+			otelgrpc.StreamClientInterceptor(),
+			deadlines.StreamClientInterceptor(),
+		),
+	)
 	if err != nil {
 		log.Fatalf("did not connect to logger: %v", err)
 	}
@@ -56,14 +119,38 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
+	// Continue the trace started by the client
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			otelgrpc.UnaryServerInterceptor(),
+			deadlines.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			otelgrpc.StreamServerInterceptor(),
+			deadlines.StreamServerInterceptor(),
+		),
+	)
 	serverpb.RegisterServerServer(s, srv)
 
 	// Enable reflection for testing with grpcurl
 	reflection.Register(s)
 
-	log.Println("Server service listening on :50051")
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		log.Println("Server service listening on :50051")
+		if err := s.Serve(lis); err != nil {
+			log.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	<-stopCh
+	log.Println("Shutting down server service...")
+	s.GracefulStop()
+
+	// Flush the remaining spans
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Printf("failed to shut down tracing: %v", err)
 	}
 }
@@ -0,0 +1,224 @@
+// Package budget derives the deadlines of downstream calls from the time
+// left on the incoming request. A service handing its full deadline to the
+// next hop has no time left to build its own response once that hop is
+// slow, so part of the budget is held back as a reserve. When what remains
+// is too short to be useful, the call fails fast with DeadlineExceeded
+// instead of being sent.
+//
+// Every hop appends a record of its budget to the x-deadline-budget
+// metadata, so the last service in a chain sees where the time went. The
+// records come from callers, so only well-formed ones are forwarded, and
+// only as many as fit MaxRecords and MaxSize.
+package budget
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Header carries one record per hop, oldest first.
+const Header = "x-deadline-budget"
+
+// Limits on the records sent downstream, this hop's included. When there
+// are more, the oldest are dropped.
+const (
+	MaxRecords = 16
+	// MaxSize is the total length of the records in bytes.
+	MaxSize = 1024
+)
+
+// recordPattern matches a well-formed record, e.g.
+// "greeter;spent=0ms;remaining=998ms" or "greeter;budget=none".
+var recordPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}(;[a-z]{1,16}=[a-z0-9]{1,16})+$`)
+
+// Defaults of Config.
+const (
+	DefaultReserve = 100 * time.Millisecond
+	DefaultMinimum = 50 * time.Millisecond
+)
+
+// Config configures a Budget.
+type Config struct {
+	// Service names this hop in the budget records.
+	Service string
+	// Reserve is the time kept for this service after the downstream call
+	// returns. Defaults to DefaultReserve.
+	Reserve time.Duration
+	// Minimum is the shortest downstream deadline worth sending. Calls
+	// that would get less fail fast. Defaults to DefaultMinimum.
+	Minimum time.Duration
+	// Default is the budget of requests that arrive without a deadline.
+	// If zero, their downstream calls get no deadline either.
+	Default time.Duration
+	// Propagated means an earlier client interceptor, such as propagation
+	// rules, already forwards the incoming records. This hop's record is
+	// then appended to the outgoing ones instead of the incoming ones.
+	Propagated bool
+}
+
+// Budget derives downstream deadlines.
+type Budget struct {
+	cfg Config
+}
+
+// New returns a Budget for cfg.
+func New(cfg Config) *Budget {
+	if cfg.Reserve <= 0 {
+		cfg.Reserve = DefaultReserve
+	}
+	if cfg.Minimum <= 0 {
+		cfg.Minimum = DefaultMinimum
+	}
+	return &Budget{cfg: cfg}
+}
+
+type arrivalKey struct{}
+
+// UnaryServerInterceptor notes when requests arrive, so budget records
+// show the time spent in this service before calling downstream.
+func (b *Budget) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := b.arrive(ctx)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor notes when streams arrive.
+func (b *Budget) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := b.arrive(ss.Context())
+		defer cancel()
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// arrive records the arrival time and applies the default budget.
+func (b *Budget) arrive(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, arrivalKey{}, time.Now())
+	if _, ok := ctx.Deadline(); !ok && b.cfg.Default > 0 {
+		return context.WithTimeout(ctx, b.cfg.Default)
+	}
+	return ctx, func() {}
+}
+
+// Derive returns a context for a downstream call, whose deadline is the
+// remaining budget of ctx minus the reserve, and records the hop in the
+// outgoing metadata. It fails with DeadlineExceeded if less than the
+// minimum would be left. Call the cancel function once the call is done.
+func (b *Budget) Derive(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return b.record(ctx, "budget=none"), func() {}, nil
+	}
+
+	remaining := time.Until(deadline)
+	downstream := remaining - b.cfg.Reserve
+	if downstream < b.cfg.Minimum {
+		return nil, nil, status.Errorf(codes.DeadlineExceeded,
+			"%s: deadline budget exhausted: %v left, %v reserved, need at least %v downstream",
+			b.cfg.Service, remaining.Round(time.Millisecond), b.cfg.Reserve, b.cfg.Minimum)
+	}
+
+	hop := fmt.Sprintf("remaining=%dms;reserve=%dms;downstream=%dms",
+		remaining.Milliseconds(), b.cfg.Reserve.Milliseconds(), downstream.Milliseconds())
+	if arrival, ok := ctx.Value(arrivalKey{}).(time.Time); ok {
+		hop = fmt.Sprintf("spent=%dms;", time.Since(arrival).Milliseconds()) + hop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, downstream)
+	return b.record(ctx, hop), cancel, nil
+}
+
+// record appends the record of this hop to those received from upstream.
+func (b *Budget) record(ctx context.Context, hop string) context.Context {
+	out, _ := metadata.FromOutgoingContext(ctx)
+	out = out.Copy()
+
+	upstream := out.Get(Header)
+	if !b.cfg.Propagated {
+		in, _ := metadata.FromIncomingContext(ctx)
+		upstream = in.Get(Header)
+	}
+	own := b.cfg.Service + ";" + hop
+	out.Set(Header, append(limit(upstream, MaxRecords-1, MaxSize-len(own)), own)...)
+	return metadata.NewOutgoingContext(ctx, out)
+}
+
+// Hops returns the well-formed budget records received with the request in
+// ctx, within MaxRecords and MaxSize.
+func Hops(ctx context.Context) []string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return limit(md.Get(Header), MaxRecords, MaxSize)
+}
+
+// limit drops malformed records, then the oldest ones until at most n
+// records of at most size bytes are left.
+func limit(records []string, n, size int) []string {
+	var kept []string
+	for i := len(records) - 1; i >= 0 && len(kept) < n; i-- {
+		r := records[i]
+		if !recordPattern.MatchString(r) {
+			continue
+		}
+		if len(r) > size {
+			break
+		}
+		size -= len(r)
+		kept = append(kept, r)
+	}
+	slices.Reverse(kept)
+	return kept
+}
+
+// UnaryClientInterceptor derives the deadline of unary calls.
+func (b *Budget) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancel, err := b.Derive(ctx)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor derives the deadline of streaming calls. The
+// derived context lives as long as the stream, which gRPC releases once the
+// stream ends.
+func (b *Budget) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, cancel, err := b.Derive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		go func() {
+			<-cs.Context().Done()
+			cancel()
+		}()
+		return cs, nil
+	}
+}
+
+// serverStream overrides the context of a stream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
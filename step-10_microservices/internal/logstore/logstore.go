@@ -0,0 +1,92 @@
+// Package logstore keeps the most recent log entries of the Logger service
+// in memory, so they can be looked up by trace ID.
+package logstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultCapacity is the number of entries kept by default.
+const DefaultCapacity = 10000
+
+// Entry is a stored log entry.
+type Entry struct {
+	ID      string
+	Time    time.Time
+	Service string
+	Level   string
+	Message string
+	TraceID string
+	SpanID  string
+}
+
+// Store is a fixed-size ring of entries. Once full, adding an entry evicts
+// the oldest one.
+type Store struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+	seq     uint64
+}
+
+// New returns a store keeping up to capacity entries, or DefaultCapacity if
+// capacity is not positive.
+func New(capacity int) *Store {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Store{entries: make([]Entry, capacity)}
+}
+
+// Add stores e, assigning its ID and, if unset, its time, and returns the
+// stored entry.
+func (s *Store) Add(e Entry) Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	e.ID = fmt.Sprintf("log-%d", s.seq)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	s.entries[s.next] = e
+	s.next = (s.next + 1) % len(s.entries)
+	if s.next == 0 {
+		s.full = true
+	}
+	return e
+}
+
+// Query returns the entries of the trace traceID, oldest first, at most
+// limit of them if limit is positive. An empty traceID matches every entry.
+func (s *Store) Query(traceID string, limit int) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []Entry
+	s.each(func(e Entry) bool {
+		if traceID != "" && e.TraceID != traceID {
+			return true
+		}
+		result = append(result, e)
+		return limit <= 0 || len(result) < limit
+	})
+	return result
+}
+
+// each calls f on the entries, oldest first, until f returns false.
+func (s *Store) each(f func(Entry) bool) {
+	start, n := 0, s.next
+	if s.full {
+		start, n = s.next, len(s.entries)
+	}
+	for i := 0; i < n; i++ {
+		if !f(s.entries[(start+i)%len(s.entries)]) {
+			return
+		}
+	}
+}
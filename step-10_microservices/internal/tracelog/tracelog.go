@@ -0,0 +1,68 @@
+// Package tracelog joins logs and traces. Its slog handler adds the IDs of
+// the active span to every record logged with a context, so a trace ID from
+// Jaeger finds the matching log lines and the other way around.
+package tracelog
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Keys of the fields added to log records.
+const (
+	TraceIDKey = "trace_id"
+	SpanIDKey  = "span_id"
+)
+
+// Handler adds trace_id and span_id to records logged within a span. Use
+// the Context variants of the slog functions, e.g. slog.InfoContext, since
+// the span is read from the context. Records that already carry a trace_id,
+// such as entries relayed on behalf of another service, are left alone.
+type Handler struct {
+	slog.Handler
+}
+
+// NewHandler wraps h.
+func NewHandler(h slog.Handler) *Handler {
+	return &Handler{Handler: h}
+}
+
+// Handle implements slog.Handler.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if traceID, spanID := IDs(ctx); traceID != "" && !hasTraceID(r) {
+		r = r.Clone()
+		r.AddAttrs(slog.String(TraceIDKey, traceID), slog.String(SpanIDKey, spanID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return NewHandler(h.Handler.WithAttrs(attrs))
+}
+
+// WithGroup implements slog.Handler.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return NewHandler(h.Handler.WithGroup(name))
+}
+
+// IDs returns the hex trace and span IDs of the span in ctx, or empty
+// strings outside of a span.
+func IDs(ctx context.Context) (traceID, spanID string) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", ""
+	}
+	return sc.TraceID().String(), sc.SpanID().String()
+}
+
+func hasTraceID(r slog.Record) bool {
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		found = a.Key == TraceIDKey
+		return !found
+	})
+	return found
+}
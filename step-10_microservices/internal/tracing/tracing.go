@@ -0,0 +1,126 @@
+// Package tracing sets up OpenTelemetry for the services of this step, so
+// a single client request shows up as one trace across the client, the
+// Server and the Logger.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Supported exporters.
+const (
+	ExporterOTLPHTTP = "otlphttp"
+	ExporterStdout   = "stdout"
+	ExporterFile     = "file"
+	ExporterNone     = "none"
+)
+
+// DefaultOTLPHTTPEndpoint is the OTLP/HTTP port of a local Jaeger.
+const DefaultOTLPHTTPEndpoint = "localhost:4318"
+
+// Config selects where spans go.
+type Config struct {
+	ServiceName string
+
+	// Exporter is one of the Exporter constants.
+	Exporter string
+	// Endpoint is the host:port of the collector for ExporterOTLPHTTP.
+	// Defaults to DefaultOTLPHTTPEndpoint.
+	Endpoint string
+	// File receives one JSON span per line for ExporterFile.
+	File string
+}
+
+// Init installs a global tracer provider exporting as configured, and the
+// W3C trace context propagator that carries traces across gRPC calls. The
+// returned function flushes the remaining spans; call it before exiting.
+func Init(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(cfg.ServiceName),
+		)),
+	}
+
+	exp, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if exp != nil {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return tp.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case ExporterOTLPHTTP:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultOTLPHTTPEndpoint
+		}
+		return otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpoint(endpoint),
+			otlptracehttp.WithInsecure(),
+		)
+
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("the file trace exporter needs a file name")
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		// Without pretty printing every span is written as one line.
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileExporter{SpanExporter: exp, file: f}, nil
+
+	case ExporterNone:
+		// Spans are still created, so trace IDs propagate and reach the
+		// Logger, but nothing is exported.
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want %s, %s, %s or %s",
+			cfg.Exporter, ExporterOTLPHTTP, ExporterStdout, ExporterFile, ExporterNone)
+	}
+}
+
+// fileExporter closes the trace file once the exporter is shut down.
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if cerr := e.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
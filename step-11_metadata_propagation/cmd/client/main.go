@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
@@ -10,9 +12,14 @@ import (
 	"google.golang.org/grpc/metadata"
 
 	pb "step-11_metadata_propagation/internal/greeter"
+	"step-11_metadata_propagation/internal/requestid"
 )
 
 func main() {
+	requestID := flag.String("request-id", "", "Request ID to send; the server generates one if empty")
+	timeout := flag.Duration("timeout", time.Second, "Deadline of the call")
+	flag.Parse()
+
 	// Set up a connection to the server.
 	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -25,20 +32,27 @@ func main() {
 	// Prepare metadata
 	md := metadata.Pairs(
 		"x-user-id", "user123",
-		"x-request-id", "req-12345",
+		"x-client-version", "1.4.2",
+		// Meant for the Greeter only; it is not propagated to the Logger
+		"authorization", "Bearer demo-token",
 	)
+	if *requestID != "" {
+		md.Set(requestid.Header, *requestID)
+	}
 
 	// Create a new context with metadata
 	ctx := metadata.NewOutgoingContext(context.Background(), md)
 
 	// Set a timeout for the RPC
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
 	defer cancel()
 
-	// Make the RPC call
-	r, err := c.SayHello(ctx, &pb.HelloRequest{Name: "World"})
+	// Make the RPC call, reading the request ID from the response header
+	var header metadata.MD
+	r, err := c.SayHello(ctx, &pb.HelloRequest{Name: "World"}, grpc.Header(&header))
+	reqID := strings.Join(header.Get(requestid.Header), ",")
 	if err != nil {
-		log.Fatalf("could not greet: %v", err)
+		log.Fatalf("could not greet (request ID %s): %v", reqID, err)
 	}
-	log.Printf("Response: %s", r.Message)
+	log.Printf("Response: %s (request ID %s)", r.Message, reqID)
 }
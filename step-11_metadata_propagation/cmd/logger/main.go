@@ -6,9 +6,12 @@ import (
 	"net"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 
+	"step-11_metadata_propagation/internal/budget"
 	loggerpb "step-11_metadata_propagation/internal/logger"
+	"step-11_metadata_propagation/internal/requestid"
 )
 
 type server struct {
@@ -16,7 +19,12 @@ type server struct {
 }
 
 func (s *server) Log(ctx context.Context, req *loggerpb.LogRequest) (*loggerpb.LogResponse, error) {
-	log.Printf("[%s] %s: %s", req.GetLevel(), req.GetService(), req.GetMessage())
+	reqID, _ := requestid.FromContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	log.Printf("[%s] [%s] %s: %s (metadata: %v)", reqID, req.GetLevel(), req.GetService(), req.GetMessage(), md)
+	for _, hop := range budget.Hops(ctx) {
+		log.Printf("[%s] deadline budget: %s", reqID, hop)
+	}
 	return &loggerpb.LogResponse{
 		Success:   true,
 		MessageId: "log-" + req.GetService() + "-" + req.GetLevel(),
@@ -29,7 +37,10 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(requestid.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(requestid.StreamServerInterceptor()),
+	)
 	loggerpb.RegisterLoggerServer(s, &server{})
 
 	// Enable reflection for testing with grpcurl
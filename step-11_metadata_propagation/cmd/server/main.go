@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 
+	"step-11_metadata_propagation/internal/budget"
 	pb "step-11_metadata_propagation/internal/greeter"
 	loggerpb "step-11_metadata_propagation/internal/logger"
+	"step-11_metadata_propagation/internal/propagation"
+	"step-11_metadata_propagation/internal/requestid"
 )
 
 type server struct {
@@ -21,22 +26,22 @@ type server struct {
 func (s *server) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloReply, error) {
 	// Extract incoming metadata
 	md, _ := metadata.FromIncomingContext(ctx)
-	log.Printf("Received request with metadata: %v", md)
-
-	// Create a new context with the incoming metadata
-	ctx = metadata.NewOutgoingContext(ctx, md)
+	reqID, _ := requestid.FromContext(ctx)
+	log.Printf("[%s] Received request with metadata: %v", reqID, md)
 
 	// Call Logger service (in a real app, this would be a separate service)
-	log.Printf("Forwarding metadata to Logger service: %v", md)
+	log.Printf("[%s] Forwarding metadata to Logger service", reqID)
 
-	// Send metadata to Logger service
+	// Send metadata to Logger service. The propagation interceptors forward
+	// the allowed incoming metadata, and the requestid interceptors add the
+	// request ID if the caller did not send one.
 	_, err := s.loggerClient.Log(ctx, &loggerpb.LogRequest{
 		Message: "Forwarded metadata",
 		Service: "GreeterService",
 		Level:   "INFO",
 	})
 	if err != nil {
-		log.Printf("Failed to log metadata: %v", err)
+		log.Printf("[%s] Failed to log metadata: %v", reqID, err)
 	}
 
 	return &pb.HelloReply{
@@ -45,13 +50,63 @@ func (s *server) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloR
 }
 
 func main() {
+	reserve := flag.Duration("budget-reserve", budget.DefaultReserve, "Time kept for the Greeter after calling the Logger")
+	minimum := flag.Duration("budget-min", budget.DefaultMinimum, "Shortest deadline worth sending to the Logger; less fails fast")
+	defaultBudget := flag.Duration("budget-default", time.Second, "Budget of requests that arrive without a deadline")
+	flag.Parse()
+
 	lis, err := net.Listen("tcp", ":50051")
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
+	// Only forward the metadata downstream services need. Credentials
+	// and transport headers of the incoming call stay here. The request ID
+	// is left to the requestid interceptor, which sends the validated one
+	// and not whatever the caller sent.
+	propagator, err := propagation.New(propagation.Config{
+		Rules: []propagation.Rule{
+			{Key: "x-user-*", MaxSize: 256},
+			{Key: "baggage", MaxSize: 8192},
+			// Tell the Logger which client version the request came from
+			{Key: "x-client-version", Rename: "x-origin-client-version", MaxSize: 64},
+			// Budget records of the upstream hops, to which deadlines
+			// appends the Greeter's
+			{Key: budget.Header, MaxSize: budget.MaxSize},
+		},
+		OnDrop: func(key string, size int) {
+			log.Printf("Not propagating %s: %d bytes over its limit", key, size)
+		},
+	})
+	if err != nil {
+		log.Fatalf("invalid propagation rules: %v", err)
+	}
+
+	// Calls to the Logger get the remaining budget of the request minus a
+	// reserve for building the Greeter's own response
+	deadlines := budget.New(budget.Config{
+		Service: "greeter",
+		Reserve: *reserve,
+		Minimum: *minimum,
+		Default: *defaultBudget,
+		// The propagator above forwards the upstream records
+		Propagated: true,
+	})
+
 	// Create a connection to the Logger service
-	conn, err := grpc.Dial(":50052", grpc.WithInsecure())
+	conn, err := grpc.Dial(":50052",
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(
+			propagator.UnaryClientInterceptor(),
+			requestid.UnaryClientInterceptor(),
+			deadlines.UnaryClientInterceptor(),
+		),
+		grpc.WithChainStreamInterceptor(
+			propagator.StreamClientInterceptor(),
+			requestid.StreamClientInterceptor(),
+			deadlines.StreamClientInterceptor(),
+		),
+	)
 	if err != nil {
 		log.Fatalf("failed to connect to Logger service: %v", err)
 	}
@@ -59,7 +114,17 @@ func main() {
 
 	loggerClient := loggerpb.NewLoggerClient(conn)
 
-	s := grpc.NewServer()
+	// Every request gets an ID, returned in the x-request-id response header
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			requestid.UnaryServerInterceptor(),
+			deadlines.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			requestid.StreamServerInterceptor(),
+			deadlines.StreamServerInterceptor(),
+		),
+	)
 	pb.RegisterGreeterServer(s, &server{loggerClient: loggerClient})
 
 	// Register reflection service on gRPC server
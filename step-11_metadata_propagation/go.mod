@@ -3,6 +3,7 @@ module step-11_metadata_propagation
 go 1.24.0
 
 require (
+	github.com/google/uuid v1.6.0
 	google.golang.org/grpc v1.72.2
 	google.golang.org/protobuf v1.36.6
 )
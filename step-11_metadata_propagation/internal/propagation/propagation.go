@@ -0,0 +1,163 @@
+// Package propagation forwards selected incoming metadata to outgoing calls.
+// Copying all incoming metadata would leak credentials such as
+// authorization to every downstream service and resend transport headers
+// like :authority, content-type and user-agent that describe the wrong
+// hop. A Propagator only forwards the keys its rules allow, within size
+// limits, optionally under a new name.
+package propagation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultMaxSize is the default limit, in bytes, on the values of a key.
+const DefaultMaxSize = 1024
+
+// Rule allows a key, or a family of keys, to be propagated.
+type Rule struct {
+	// Key is an exact key, e.g. "baggage", or a prefix ending in "*",
+	// e.g. "x-user-*". Keys are case-insensitive.
+	Key string
+	// Rename optionally forwards the key under another name. For prefix
+	// rules it must be a prefix too, which replaces the matched one, e.g.
+	// "x-origin-user-*" turns x-user-id into x-origin-user-id.
+	Rename string
+	// MaxSize limits the total length of the values of a key. Keys over
+	// the limit are dropped. Defaults to DefaultMaxSize.
+	MaxSize int
+}
+
+// Config configures a Propagator.
+type Config struct {
+	// Rules are tried in order, and the first matching one applies. Keys
+	// that match no rule are not propagated.
+	Rules []Rule
+	// OnDrop, if set, is called for allowed keys dropped for their size.
+	OnDrop func(key string, size int)
+}
+
+// Propagator copies allowed metadata from incoming to outgoing contexts.
+type Propagator struct {
+	rules  []Rule
+	onDrop func(key string, size int)
+}
+
+// New returns a Propagator applying cfg, or an error if a rule is invalid.
+func New(cfg Config) (*Propagator, error) {
+	p := &Propagator{onDrop: cfg.OnDrop}
+	for _, r := range cfg.Rules {
+		r.Key = strings.ToLower(r.Key)
+		r.Rename = strings.ToLower(r.Rename)
+		if r.MaxSize <= 0 {
+			r.MaxSize = DefaultMaxSize
+		}
+
+		name := strings.TrimSuffix(r.Key, "*")
+		if name == "" || strings.Contains(name, "*") {
+			return nil, fmt.Errorf("invalid propagation key %q", r.Key)
+		}
+		// Pseudo-headers and grpc- headers belong to the transport and
+		// describe a single hop
+		if strings.HasPrefix(name, ":") || strings.HasPrefix(name, "grpc-") {
+			return nil, fmt.Errorf("propagation key %q is reserved", r.Key)
+		}
+		if r.Rename != "" && isPrefix(r.Key) != isPrefix(r.Rename) {
+			return nil, fmt.Errorf("propagation key %q and its rename %q must both be exact keys or both prefixes", r.Key, r.Rename)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// Outgoing returns ctx with the allowed incoming metadata added to its
+// outgoing metadata. Keys already set on the outgoing metadata are kept.
+func (p *Propagator) Outgoing(ctx context.Context) context.Context {
+	in, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	out, _ := metadata.FromOutgoingContext(ctx)
+	out = out.Copy()
+
+	added := false
+	for key, values := range in {
+		name, ok := p.allow(key, values)
+		if !ok || len(out.Get(name)) > 0 {
+			continue
+		}
+		out.Set(name, values...)
+		added = true
+	}
+	if !added {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, out)
+}
+
+// allow returns the outgoing name of key if a rule allows it and its
+// values fit the rule's size limit.
+func (p *Propagator) allow(key string, values []string) (string, bool) {
+	for _, r := range p.rules {
+		suffix, ok := match(r.Key, key)
+		if !ok {
+			continue
+		}
+
+		size := 0
+		for _, v := range values {
+			size += len(v)
+		}
+		if size > r.MaxSize {
+			if p.onDrop != nil {
+				p.onDrop(key, size)
+			}
+			return "", false
+		}
+
+		switch {
+		case r.Rename == "":
+			return key, true
+		case isPrefix(r.Rename):
+			return strings.TrimSuffix(r.Rename, "*") + suffix, true
+		default:
+			return r.Rename, true
+		}
+	}
+	return "", false
+}
+
+// UnaryClientInterceptor propagates metadata on unary calls.
+func (p *Propagator) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(p.Outgoing(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor propagates metadata on streaming calls.
+func (p *Propagator) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(p.Outgoing(ctx), desc, cc, method, opts...)
+	}
+}
+
+// match reports whether key matches pattern, and returns the part of key
+// matched by the "*" of a prefix pattern.
+func match(pattern, key string) (string, bool) {
+	if !isPrefix(pattern) {
+		return "", key == pattern
+	}
+	prefix := strings.TrimSuffix(pattern, "*")
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(key, prefix), true
+}
+
+func isPrefix(pattern string) bool {
+	return strings.HasSuffix(pattern, "*")
+}
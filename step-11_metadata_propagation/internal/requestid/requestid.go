@@ -0,0 +1,130 @@
+// Package requestid gives every request an ID that follows it across
+// services. The server interceptors adopt the x-request-id sent by the
+// caller, or generate a UUIDv7 when there is none, store it in the context
+// and return it in the response headers. The client interceptors forward
+// the ID of the context on every outgoing call, so handlers never copy it
+// by hand.
+package requestid
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Header is the metadata key carrying the request ID.
+const Header = "x-request-id"
+
+// maxLen bounds the length of IDs accepted from callers.
+const maxLen = 128
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID of ctx, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok && id != ""
+}
+
+// New returns a new request ID. UUIDv7 starts with a timestamp, so IDs sort
+// by creation time.
+func New() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		// Only fails if the random source does
+		return uuid.NewString()
+	}
+	return id.String()
+}
+
+// UnaryServerInterceptor assigns request IDs to unary calls.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		id := incoming(ctx)
+		// The header goes out with the response, or the error if the
+		// handler fails
+		if err := grpc.SetHeader(ctx, metadata.Pairs(Header, id)); err != nil {
+			return nil, err
+		}
+		return handler(NewContext(ctx, id), req)
+	}
+}
+
+// StreamServerInterceptor assigns request IDs to streaming calls.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		id := incoming(ss.Context())
+		if err := ss.SetHeader(metadata.Pairs(Header, id)); err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: NewContext(ss.Context(), id)})
+	}
+}
+
+// UnaryClientInterceptor forwards the request ID of the context.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoing(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor forwards the request ID of the context.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoing(ctx), desc, cc, method, opts...)
+	}
+}
+
+// incoming returns the request ID sent by the caller, or a new one if it
+// is missing or malformed.
+func incoming(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(Header); len(v) > 0 && valid(v[0]) {
+		return v[0]
+	}
+	return New()
+}
+
+// outgoing adds the request ID of ctx to its outgoing metadata, unless the
+// caller set one explicitly.
+func outgoing(ctx context.Context) context.Context {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	if md, _ := metadata.FromOutgoingContext(ctx); len(md.Get(Header)) > 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, Header, id)
+}
+
+// valid accepts IDs of printable ASCII, so callers cannot inject line
+// breaks or control characters into logs.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// serverStream overrides the context of a stream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -2,63 +2,81 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"step-12_load_balancing/internal/fileresolver"
 	greeterpb "step-12_load_balancing/internal/greeter"
+	_ "step-12_load_balancing/internal/leastrequest" // registers least_request
+	"step-12_load_balancing/internal/outlier"
+	registrypb "step-12_load_balancing/internal/registry"
+	"step-12_load_balancing/internal/registryresolver"
+	"step-12_load_balancing/internal/ringhash"
+	_ "step-12_load_balancing/internal/wrr"       // registers wrr
+	_ "step-12_load_balancing/internal/zoneaware" // registers zone_aware
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
-const (
-	// Using DNS resolver with multiple server addresses
-	serviceAddress = "dns:///example.com"
-	server1        = "localhost:50051"
-	server2        = "localhost:50052"
-)
-
-// dnsResolverBuilder is a custom resolver that returns the list of server addresses
-type dnsResolverBuilder struct {
-	servers []string
-}
-
-func (b *dnsResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
-	addrs := make([]resolver.Address, len(b.servers))
-	for i, s := range b.servers {
-		addrs[i] = resolver.Address{Addr: s}
+func main() {
+	// The servers are listed in an endpoints file, re-read while the
+	// client runs, or registered with the registry
+	target := flag.String("target", "file:endpoints.json", "Target to dial: file:endpoints.json, file:///etc/greeter/endpoints.json or registry://localhost:50100/greeter")
+	requests := flag.Int("requests", 5, "Number of requests to send")
+	interval := flag.Duration("interval", 500*time.Millisecond, "Delay between requests")
+	concurrency := flag.Int("concurrency", 1, "Number of requests in flight at once")
+	policy := flag.String("policy", "round_robin", "Load balancing policy: round_robin, wrr, least_request, ring_hash, outlier_detection or zone_aware")
+	users := flag.Int("users", 0, "Send requests as this many users, in turn, with x-user-id; none if 0")
+	serviceConfig := flag.String("service-config", "", `Service config overriding -policy, e.g. {"loadBalancingConfig":[{"wrr":{"enableServerLoad":true}}]}`)
+	flag.Parse()
+
+	if *serviceConfig == "" {
+		*serviceConfig = fmt.Sprintf(`{"loadBalancingConfig":[{%q:{}}]}`, *policy)
 	}
-	cc.UpdateState(resolver.State{
-		Addresses: addrs,
-	})
-	return &dnsResolver{cc: cc}, nil
-}
 
-func (b *dnsResolverBuilder) Scheme() string { return "dns" }
-
-type dnsResolver struct {
-	cc resolver.ClientConn
-}
-
-func (r *dnsResolver) ResolveNow(resolver.ResolveNowOptions) {}
-func (r *dnsResolver) Close()                                {}
+	// Resolve file: targets, logging every change of the endpoints
+	fileResolver := &fileresolver.Builder{
+		OnUpdate: func(path string, endpoints []fileresolver.Endpoint, err error) {
+			if err != nil {
+				log.Printf("Endpoints file %s unusable: %v", path, err)
+				return
+			}
+			log.Printf("Endpoints from %s: %+v", path, endpoints)
+		},
+	}
 
-func main() {
-	// Register a custom resolver that knows about our servers
-	dnsResolverBuilder := &dnsResolverBuilder{
-		servers: []string{server1, server2},
+	// Resolve registry: targets, logging every membership change
+	registryResolver := &registryresolver.Builder{
+		OnUpdate: func(service string, instances []*registrypb.Instance, err error) {
+			if err != nil {
+				log.Printf("Lost the registry: %v", err)
+				return
+			}
+			log.Printf("Instances of %s: %d", service, len(instances))
+			for _, in := range instances {
+				log.Printf("  %s %s (zone %q, weight %d, priority %d)", in.GetId(), in.GetAddress(), in.GetZone(), in.GetWeight(), in.GetPriority())
+			}
+		},
 	}
-	resolver.Register(dnsResolverBuilder)
 
-	// Create a connection to the servers with round-robin load balancing
-	log.Printf("Connecting to servers: %s, %s...", server1, server2)
+	// Create a connection to the servers with the chosen load balancing
+	log.Printf("Connecting to %s with %s...", *target, *serviceConfig)
 	conn, err := grpc.Dial(
-		serviceAddress,
+		*target,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy":"round_robin"}`),
-		grpc.WithBlock(),
+		grpc.WithResolvers(fileResolver, registryResolver),
+		grpc.WithDefaultServiceConfig(*serviceConfig),
+		// Let ring_hash read the ringhash.Key call option
+		grpc.WithUnaryInterceptor(ringhash.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(ringhash.StreamClientInterceptor()),
 	)
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
@@ -67,29 +85,85 @@ func main() {
 
 	client := greeterpb.NewGreeterClient(conn)
 
-	// Send multiple requests to see load balancing in action
-	for i := 0; i < 5; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-
-		// Add a small delay between requests
-		time.Sleep(500 * time.Millisecond)
-
-		// Create a unique name for each request
-		name := fmt.Sprintf("World-%d", i+1)
-		log.Printf("Sending request %d for name: %s", i+1, name)
+	// Count the responses of every server
+	var (
+		mu        sync.Mutex
+		perServer = make(map[string]int)
+		perUser   = make(map[string]map[string]int)
+	)
 
-		// Make the RPC call
-		start := time.Now()
-		response, err := client.SayHello(ctx, &greeterpb.HelloRequest{Name: name})
-		elapsed := time.Since(start)
+	// Send multiple requests to see load balancing in action, from
+	// -concurrency workers
+	requestsCh := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range requestsCh {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+
+				// Create a unique name for each request
+				name := fmt.Sprintf("World-%d", i+1)
+
+				// Take turns among the users, so ring_hash can keep each
+				// on one server
+				var user string
+				if *users > 0 {
+					user = fmt.Sprintf("user-%d", i%*users+1)
+					ctx = metadata.AppendToOutgoingContext(ctx, "x-user-id", user)
+					name += " as " + user
+				}
+				log.Printf("Sending request %d for name: %s", i+1, name)
+
+				// Make the RPC call
+				var p peer.Peer
+				start := time.Now()
+				response, err := client.SayHello(ctx, &greeterpb.HelloRequest{Name: name}, grpc.Peer(&p))
+				elapsed := time.Since(start)
+
+				// Handle the response
+				if err != nil {
+					log.Printf("Error calling SayHello for %s: %v", name, err)
+				} else {
+					log.Printf("Response %d: %s (took %v)", i+1, response.Message, elapsed)
+					mu.Lock()
+					perServer[p.Addr.String()]++
+					if user != "" {
+						if perUser[user] == nil {
+							perUser[user] = make(map[string]int)
+						}
+						perUser[user][p.Addr.String()]++
+					}
+					mu.Unlock()
+				}
+
+				cancel()
+			}
+		}()
+	}
 
-		// Handle the response
-		if err != nil {
-			log.Printf("Error calling SayHello for %s: %v", name, err)
-		} else {
-			log.Printf("Response %d: %s (took %v)", i+1, response.Message, elapsed)
-		}
+	for i := 0; i < *requests; i++ {
+		// Add a small delay between requests
+		time.Sleep(*interval)
+		requestsCh <- i
+	}
+	close(requestsCh)
+	wg.Wait()
 
-		cancel()
+	servers := make([]string, 0, len(perServer))
+	for addr := range perServer {
+		servers = append(servers, addr)
+	}
+	sort.Strings(servers)
+	for _, addr := range servers {
+		log.Printf("Responses from %s: %d", addr, perServer[addr])
+	}
+	for u := 1; u <= *users; u++ {
+		user := fmt.Sprintf("user-%d", u)
+		log.Printf("Servers of %s: %v", user, perUser[user])
+	}
+	if strings.Contains(*serviceConfig, outlier.Name) {
+		log.Printf("Outlier detection: %s", outlier.Metrics)
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+
+	registrypb "step-12_load_balancing/internal/registry"
+	"step-12_load_balancing/internal/registryserver"
+)
+
+func main() {
+	addr := flag.String("addr", ":50100", "Address to listen on")
+	defaultLease := flag.Duration("default-lease", registryserver.DefaultLease, "Lease of instances that do not request one")
+	maxLease := flag.Duration("max-lease", registryserver.DefaultMaxLease, "Longest lease granted")
+	flag.Parse()
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %v", *addr, err)
+	}
+
+	registry := registryserver.New(registryserver.Options{
+		DefaultLease: *defaultLease,
+		MaxLease:     *maxLease,
+		Logf:         log.Printf,
+	})
+
+	s := grpc.NewServer()
+	registrypb.RegisterRegistryServer(s, registry)
+	reflection.Register(s)
+
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		log.Printf("Registry listening at %v", lis.Addr())
+		if err := s.Serve(lis); err != nil {
+			log.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	<-stopCh
+	log.Println("Shutting down registry...")
+	// Ends the WatchService streams, which would block GracefulStop
+	registry.Close()
+	s.GracefulStop()
+}
@@ -2,24 +2,50 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	greeterpb "step-12_load_balancing/internal/greeter"
+	"step-12_load_balancing/internal/loadreport"
+	"step-12_load_balancing/internal/registration"
+	registrypb "step-12_load_balancing/internal/registry"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
 	greeterpb.UnimplementedGreeterServer
-	port string
+	port      string
+	delay     time.Duration
+	errorRate float64
 }
 
 func (s *server) SayHello(ctx context.Context, in *greeterpb.HelloRequest) (*greeterpb.HelloReply, error) {
 	log.Printf("Received request from client for name: %s", in.Name)
+	// Simulate a slower server
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	// Simulate a failing server
+	if rand.Float64() < s.errorRate {
+		log.Printf("Failing request for name: %s", in.Name)
+		return nil, status.Errorf(codes.Unavailable, "server on port %s is failing", s.port)
+	}
 	resp := &greeterpb.HelloReply{
 		Message: fmt.Sprintf("Hello %s (from server on port %s)", in.Name, s.port),
 	}
@@ -28,6 +54,18 @@ func (s *server) SayHello(ctx context.Context, in *greeterpb.HelloRequest) (*gre
 }
 
 func main() {
+	registryAddr := flag.String("registry", "", "Registry to register with, e.g. localhost:50100; none if empty")
+	service := flag.String("service", "greeter", "Service name to register as")
+	advertise := flag.String("advertise", "", "Address clients should use (default localhost:$PORT)")
+	zone := flag.String("zone", "", "Zone to register in")
+	weight := flag.Uint("weight", 1, "Weight to register with")
+	priority := flag.Uint("priority", 0, "Priority to register with, 0 being the highest")
+	lease := flag.Duration("lease", registration.DefaultLease, "Registration lease, renewed by heartbeats")
+	delay := flag.Duration("delay", 0, "Time taken by every request, to simulate a slow server")
+	errorRate := flag.Float64("error-rate", 0, "Fraction of requests failing with Unavailable, to simulate a failing server")
+	capacity := flag.Int("capacity", loadreport.DefaultCapacity, "Concurrent requests of a fully used server, for the reported utilization")
+	flag.Parse()
+
 	// Get port from environment variable or use default
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -41,15 +79,65 @@ func main() {
 		log.Fatalf("failed to listen on port %s: %v", port, err)
 	}
 
-	srv := &server{port: port}
+	srv := &server{port: port, delay: *delay, errorRate: *errorRate}
 	log.Printf("Server started on %s", addr)
 
-	s := grpc.NewServer()
+	// Report the utilization in trailers, for the wrr policy
+	load := loadreport.New(*capacity)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(load.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(load.StreamServerInterceptor()),
+	)
 	greeterpb.RegisterGreeterServer(s, srv)
 	reflection.Register(s)
 
-	log.Printf("Server %s listening at %v", os.Args[0], lis.Addr())
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		log.Printf("Server %s listening at %v", os.Args[0], lis.Addr())
+		if err := s.Serve(lis); err != nil {
+			log.Fatalf("failed to serve: %v", err)
+		}
+	}()
+
+	// Register once serving, so clients never find an instance that is
+	// not listening yet
+	var reg *registration.Registration
+	if *registryAddr != "" {
+		conn, err := grpc.NewClient(*registryAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatalf("failed to connect to registry: %v", err)
+		}
+		defer conn.Close()
+
+		if *advertise == "" {
+			*advertise = "localhost:" + port
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reg, err = registration.Register(ctx, conn, &registrypb.Instance{
+			Service:  *service,
+			Address:  *advertise,
+			Zone:     *zone,
+			Weight:   uint32(*weight),
+			Priority: uint32(*priority),
+		}, registration.Options{Lease: *lease, Logf: log.Printf})
+		cancel()
+		if err != nil {
+			log.Fatalf("failed to register with %s: %v", *registryAddr, err)
+		}
+	}
+
+	<-stopCh
+	log.Println("Shutting down server...")
+
+	// Deregister first, so clients move away before the server stops
+	if reg != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := reg.Deregister(ctx); err != nil {
+			log.Printf("Failed to deregister: %v", err)
+		}
+		cancel()
 	}
+	s.GracefulStop()
 }
@@ -0,0 +1,58 @@
+// Package addrattr attaches service discovery data to resolver addresses,
+// so resolvers can hand it to load balancing policies. The values are
+// balancer attributes: changing them does not recreate connections.
+package addrattr
+
+import (
+	"google.golang.org/grpc/resolver"
+)
+
+// DefaultWeight is the weight of addresses without one.
+const DefaultWeight = 1
+
+type zoneKey struct{}
+
+type weightKey struct{}
+
+type priorityKey struct{}
+
+// WithZone returns a copy of addr in zone.
+func WithZone(addr resolver.Address, zone string) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(zoneKey{}, zone)
+	return addr
+}
+
+// Zone returns the zone of addr, or "" if unknown.
+func Zone(addr resolver.Address) string {
+	zone, _ := addr.BalancerAttributes.Value(zoneKey{}).(string)
+	return zone
+}
+
+// WithWeight returns a copy of addr with weight, which relative to the
+// weights of the other addresses sets its share of the traffic.
+func WithWeight(addr resolver.Address, weight uint32) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(weightKey{}, weight)
+	return addr
+}
+
+// Weight returns the weight of addr, or DefaultWeight if it has none.
+func Weight(addr resolver.Address) uint32 {
+	if weight, ok := addr.BalancerAttributes.Value(weightKey{}).(uint32); ok && weight > 0 {
+		return weight
+	}
+	return DefaultWeight
+}
+
+// WithPriority returns a copy of addr at priority. Priority 0 is the
+// highest; lower priorities only get traffic when the higher ones lack
+// healthy servers.
+func WithPriority(addr resolver.Address, priority uint32) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(priorityKey{}, priority)
+	return addr
+}
+
+// Priority returns the priority of addr, or 0 if it has none.
+func Priority(addr resolver.Address) uint32 {
+	priority, _ := addr.BalancerAttributes.Value(priorityKey{}).(uint32)
+	return priority
+}
@@ -0,0 +1,219 @@
+// Package fileresolver discovers servers from an endpoints file, for
+// targets like file:///etc/greeter/endpoints.json or, relative to the
+// working directory, file:endpoints.json. The file is JSON or YAML:
+//
+//	{
+//	  "endpoints": [
+//	    {"address": "localhost:50051", "zone": "zone-a", "weight": 3},
+//	    {"address": "localhost:50052", "zone": "zone-b", "priority": 1}
+//	  ]
+//	}
+//
+// The resolver re-reads the file periodically and on ResolveNow, and pushes
+// the endpoints to the channel whenever they change. Zones, weights and
+// priorities go on the addresses through package addrattr. A missing or
+// invalid file is reported to the channel, which keeps using the last good
+// endpoints.
+package fileresolver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"gopkg.in/yaml.v3"
+
+	"step-12_load_balancing/internal/addrattr"
+)
+
+// Scheme is the scheme of the targets handled by this resolver.
+const Scheme = "file"
+
+// DefaultInterval is how often the file is checked for changes.
+const DefaultInterval = time.Second
+
+// Endpoint is an entry of the endpoints file.
+type Endpoint struct {
+	Address  string `yaml:"address"`
+	Zone     string `yaml:"zone"`
+	Weight   uint32 `yaml:"weight"`
+	Priority uint32 `yaml:"priority"`
+}
+
+type file struct {
+	Endpoints []Endpoint `yaml:"endpoints"`
+}
+
+// Builder builds file resolvers.
+type Builder struct {
+	// Interval between checks of the file. Defaults to DefaultInterval.
+	Interval time.Duration
+	// OnUpdate, if set, is called with the endpoints pushed to a channel,
+	// or with the error reported to it.
+	OnUpdate func(path string, endpoints []Endpoint, err error)
+}
+
+// Build implements resolver.Builder.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	// file:///abs/path has a path, file:rel/path an opaque part
+	path := target.URL.Path
+	if path == "" {
+		path = target.URL.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("fileresolver: no file in target %q", target.URL.String())
+	}
+
+	interval := b.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	r := &fileResolver{
+		path:     path,
+		cc:       cc,
+		onUpdate: b.OnUpdate,
+		interval: interval,
+		resolve:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	// Resolve once right away, so the first RPCs need not wait a tick
+	r.update()
+
+	r.wg.Add(1)
+	go r.watch()
+	return r, nil
+}
+
+// Scheme implements resolver.Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+type fileResolver struct {
+	path     string
+	cc       resolver.ClientConn
+	onUpdate func(path string, endpoints []Endpoint, err error)
+	interval time.Duration
+
+	resolve chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	// Only accessed by update, which never runs concurrently
+	last    []byte
+	failed  bool
+	lastErr string
+}
+
+// ResolveNow implements resolver.Resolver.
+func (r *fileResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolve <- struct{}{}:
+	default:
+	}
+}
+
+// Close implements resolver.Resolver.
+func (r *fileResolver) Close() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+func (r *fileResolver) watch() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.resolve:
+		}
+		r.update()
+	}
+}
+
+// update reads the file and pushes its endpoints if they changed, or
+// reports why it cannot be used.
+func (r *fileResolver) update() {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		r.fail(fmt.Errorf("fileresolver: %v", err))
+		return
+	}
+	// Unchanged since the last successful update
+	if !r.failed && r.last != nil && bytes.Equal(data, r.last) {
+		return
+	}
+
+	endpoints, err := parse(data)
+	if err != nil {
+		r.fail(fmt.Errorf("fileresolver: %s: %v", r.path, err))
+		return
+	}
+
+	addrs := make([]resolver.Address, 0, len(endpoints))
+	for _, e := range endpoints {
+		addr := resolver.Address{Addr: e.Address}
+		addr = addrattr.WithZone(addr, e.Zone)
+		addr = addrattr.WithWeight(addr, e.Weight)
+		addr = addrattr.WithPriority(addr, e.Priority)
+		addrs = append(addrs, addr)
+	}
+	if err := r.cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		// The balancer rejected the addresses; try again on the next tick
+		r.fail(fmt.Errorf("fileresolver: %s: %v", r.path, err))
+		return
+	}
+
+	r.last, r.failed, r.lastErr = data, false, ""
+	if r.onUpdate != nil {
+		r.onUpdate(r.path, endpoints, nil)
+	}
+}
+
+// fail reports err, unless it was already reported by the previous update.
+func (r *fileResolver) fail(err error) {
+	if r.failed && err.Error() == r.lastErr {
+		return
+	}
+	r.failed, r.lastErr = true, err.Error()
+	r.cc.ReportError(err)
+	if r.onUpdate != nil {
+		r.onUpdate(r.path, nil, err)
+	}
+}
+
+// parse decodes and validates the endpoints of a file.
+func parse(data []byte) ([]Endpoint, error) {
+	var f file
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints")
+	}
+
+	seen := make(map[string]bool)
+	for i := range f.Endpoints {
+		e := &f.Endpoints[i]
+		if _, _, err := net.SplitHostPort(e.Address); err != nil {
+			return nil, fmt.Errorf("endpoint %d: %v", i, err)
+		}
+		if seen[e.Address] {
+			return nil, fmt.Errorf("endpoint %d: duplicate address %s", i, e.Address)
+		}
+		seen[e.Address] = true
+		if e.Weight == 0 {
+			e.Weight = addrattr.DefaultWeight
+		}
+	}
+	return f.Endpoints, nil
+}
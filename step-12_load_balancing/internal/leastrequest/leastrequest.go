@@ -0,0 +1,177 @@
+// Package leastrequest is a least outstanding requests load balancing
+// policy using the power of two choices: each RPC goes to the server with
+// the fewest RPCs in flight out of two distinct ones picked at random. Slow
+// servers pile up outstanding RPCs and get fewer new ones, without the
+// herding of always picking the global minimum.
+//
+// The number of servers compared can be raised:
+//
+//	{"loadBalancingConfig": [{"least_request": {"choiceCount": 3}}]}
+//
+// Importing the package registers the policy.
+package leastrequest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the name of the policy in service configs.
+const Name = "least_request"
+
+// DefaultChoiceCount is the number of servers compared per RPC.
+const DefaultChoiceCount = 2
+
+// maxChoiceCount bounds the choice count, as more gains little.
+const maxChoiceCount = 10
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// Config is the configuration of the policy.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// ChoiceCount is the number of random servers compared, from 2 to 10.
+	ChoiceCount uint32 `json:"choiceCount"`
+}
+
+type builder struct{}
+
+// Name implements balancer.Builder.
+func (builder) Name() string {
+	return Name
+}
+
+// Build implements balancer.Builder. The base balancer manages the
+// connections; each channel gets its own picker builder, which keeps the
+// outstanding RPC counts across pickers.
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{
+		choiceCount: DefaultChoiceCount,
+		inFlight:    make(map[balancer.SubConn]*atomic.Int64),
+	}
+	return &lrBalancer{
+		Balancer: base.NewBalancerBuilder(Name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &Config{ChoiceCount: DefaultChoiceCount}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, fmt.Errorf("least_request: invalid config %s: %v", js, err)
+	}
+	if cfg.ChoiceCount < 2 {
+		return nil, fmt.Errorf("least_request: choiceCount %d is below 2", cfg.ChoiceCount)
+	}
+	cfg.ChoiceCount = min(cfg.ChoiceCount, maxChoiceCount)
+	return cfg, nil
+}
+
+type lrBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+// UpdateClientConnState hands the config to the picker builder before the
+// base balancer builds a picker.
+func (b *lrBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*Config); ok {
+		b.pb.choiceCount = int(cfg.ChoiceCount)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// ExitIdle implements balancer.ExitIdler.
+func (b *lrBalancer) ExitIdle() {
+	if ei, ok := b.Balancer.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+// pickerBuilder is only used by its balancer, which never calls it
+// concurrently.
+type pickerBuilder struct {
+	choiceCount int
+	inFlight    map[balancer.SubConn]*atomic.Int64
+}
+
+// Build implements base.PickerBuilder.
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	// Counts outlive pickers, so RPCs started with the previous picker
+	// still count, and still decrement the right counter when done
+	p := &picker{choiceCount: pb.choiceCount}
+	inFlight := make(map[balancer.SubConn]*atomic.Int64, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		n, ok := pb.inFlight[sc]
+		if !ok {
+			n = new(atomic.Int64)
+		}
+		inFlight[sc] = n
+		p.backends = append(p.backends, backend{sc: sc, inFlight: n})
+	}
+	pb.inFlight = inFlight
+	return p
+}
+
+type backend struct {
+	sc       balancer.SubConn
+	inFlight *atomic.Int64
+}
+
+type picker struct {
+	choiceCount int
+	backends    []backend
+}
+
+// Pick implements balancer.Picker. The servers compared are distinct, so
+// with two servers the less loaded one is always picked.
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	n := len(p.backends)
+	best := rand.IntN(n)
+	if p.choiceCount >= n {
+		// Comparing them all is cheaper than drawing
+		for i := range p.backends {
+			if p.backends[i].inFlight.Load() < p.backends[best].inFlight.Load() {
+				best = i
+			}
+		}
+	} else {
+		var drawn [maxChoiceCount]int
+		drawn[0] = best
+		for k := 1; k < p.choiceCount; k++ {
+			i := rand.IntN(n)
+			if slices.Contains(drawn[:k], i) {
+				k--
+				continue
+			}
+			drawn[k] = i
+			if p.backends[i].inFlight.Load() < p.backends[best].inFlight.Load() {
+				best = i
+			}
+		}
+	}
+
+	b := p.backends[best]
+	b.inFlight.Add(1)
+	return balancer.PickResult{
+		SubConn: b.sc,
+		Done: func(balancer.DoneInfo) {
+			b.inFlight.Add(-1)
+		},
+	}, nil
+}
@@ -0,0 +1,87 @@
+// Package loadreport lets servers report their load to clients in the
+// trailer of every RPC, for load balancing policies that weigh servers by
+// how busy they are.
+//
+// The load is the utilization of the server: the RPCs it is handling
+// divided by the number it can handle at once, so 0.5 means half busy and
+// values above 1 mean requests are queuing.
+package loadreport
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// TrailerKey is the trailer carrying the utilization of the server.
+const TrailerKey = "x-server-utilization"
+
+// DefaultCapacity is the number of concurrent RPCs of a fully used server.
+const DefaultCapacity = 10
+
+// Reporter counts the RPCs in flight and reports the utilization.
+type Reporter struct {
+	capacity float64
+	inFlight atomic.Int64
+}
+
+// New returns a Reporter for a server handling capacity RPCs at once.
+// A capacity below 1 means DefaultCapacity.
+func New(capacity int) *Reporter {
+	if capacity < 1 {
+		capacity = DefaultCapacity
+	}
+	return &Reporter{capacity: float64(capacity)}
+}
+
+// Utilization returns the current utilization of the server.
+func (r *Reporter) Utilization() float64 {
+	return float64(r.inFlight.Load()) / r.capacity
+}
+
+// UnaryServerInterceptor counts unary RPCs and sets the trailer.
+func (r *Reporter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		r.inFlight.Add(1)
+		defer r.inFlight.Add(-1)
+
+		resp, err := handler(ctx, req)
+		// Taken while this RPC still counts, so never below 1/capacity
+		grpc.SetTrailer(ctx, r.trailer())
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor counts streaming RPCs and sets the trailer.
+func (r *Reporter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		r.inFlight.Add(1)
+		defer r.inFlight.Add(-1)
+
+		err := handler(srv, ss)
+		ss.SetTrailer(r.trailer())
+		return err
+	}
+}
+
+func (r *Reporter) trailer() metadata.MD {
+	return metadata.Pairs(TrailerKey, strconv.FormatFloat(r.Utilization(), 'f', 3, 64))
+}
+
+// FromTrailer returns the utilization reported in trailer, and false if
+// there is none or it is not a finite, non-negative number.
+func FromTrailer(trailer metadata.MD) (float64, bool) {
+	vals := trailer.Get(TrailerKey)
+	if len(vals) == 0 {
+		return 0, false
+	}
+	u, err := strconv.ParseFloat(vals[len(vals)-1], 64)
+	if err != nil || !(u >= 0) || math.IsInf(u, 1) {
+		return 0, false
+	}
+	return u, true
+}
@@ -0,0 +1,750 @@
+// Package outlier is an outlier detection load balancing policy. It wraps
+// another policy, round_robin by default, watches the result of every RPC
+// to each server and ejects the servers that fail:
+//
+//   - consecutive failures: a server whose last consecutiveFailures RPCs
+//     failed is ejected right away
+//   - success rate: every interval, among the servers that handled at least
+//     requestVolume RPCs, a server whose success rate is more than
+//     stdevFactor standard deviations below the mean is ejected
+//
+// An ejected server looks down to the wrapped policy, which stops sending it
+// RPCs. It comes back after baseEjectionTime, doubled for every ejection in
+// a row and capped by maxEjectionTime, and the doubling is undone one step
+// per interval without an ejection. At most maxEjectionPercent of the
+// servers, rounded up, are ejected at once: any percentage above 0 lets one
+// server be ejected, and 0 disables ejection.
+//
+// Failures are RPCs ending with Unavailable, Internal, Unknown, DataLoss or
+// DeadlineExceeded; other errors are the caller's doing.
+//
+//	{"loadBalancingConfig": [{"outlier_detection": {
+//	  "interval": "1s", "baseEjectionTime": "5s", "maxEjectionTime": "1m",
+//	  "maxEjectionPercent": 50, "consecutiveFailures": 5,
+//	  "successRate": {"stdevFactor": 1.9, "minimumHosts": 3, "requestVolume": 20},
+//	  "childPolicy": [{"wrr": {}}]
+//	}}]}
+//
+// Ejections are logged through Logf and counted in the expvar map
+// "outlier_detection". Importing the package registers the policy.
+package outlier
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// Name is the name of the policy in service configs.
+const Name = "outlier_detection"
+
+// Defaults of the config.
+const (
+	DefaultInterval            = 10 * time.Second
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 5 * time.Minute
+	DefaultMaxEjectionPercent  = 10
+	DefaultConsecutiveFailures = 5
+	DefaultStdevFactor         = 1.9
+	DefaultMinimumHosts        = 5
+	DefaultRequestVolume       = 100
+	DefaultChildPolicy         = "round_robin"
+)
+
+// Logf logs ejections and their end. Set it to nil for silence.
+var Logf = log.Printf
+
+// Metrics counts ejections, by reason, and the servers ejected now:
+// ejections_consecutive_failures, ejections_success_rate, unejections and
+// ejected.
+var Metrics = expvar.NewMap("outlier_detection")
+
+var errEjected = errors.New("outlier detection: server ejected")
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// Config is the configuration of the policy.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int
+	// ConsecutiveFailures ejecting a server, or 0 to disable.
+	ConsecutiveFailures int
+	// SuccessRate, if set, enables ejection by success rate.
+	SuccessRate *SuccessRate
+
+	childName   string
+	childConfig serviceconfig.LoadBalancingConfig
+}
+
+// SuccessRate configures ejection by success rate.
+type SuccessRate struct {
+	// StdevFactor is how many standard deviations below the mean success
+	// rate a server must be to be ejected.
+	StdevFactor float64 `json:"stdevFactor"`
+	// MinimumHosts is the number of servers with RequestVolume RPCs in an
+	// interval needed to compare them.
+	MinimumHosts int `json:"minimumHosts"`
+	// RequestVolume is the number of RPCs in an interval needed for the
+	// success rate of a server to count.
+	RequestVolume int `json:"requestVolume"`
+}
+
+type builder struct{}
+
+// Name implements balancer.Builder.
+func (builder) Name() string {
+	return Name
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var raw struct {
+		Interval            string                       `json:"interval"`
+		BaseEjectionTime    string                       `json:"baseEjectionTime"`
+		MaxEjectionTime     string                       `json:"maxEjectionTime"`
+		MaxEjectionPercent  *int                         `json:"maxEjectionPercent"`
+		ConsecutiveFailures *int                         `json:"consecutiveFailures"`
+		SuccessRate         *SuccessRate                 `json:"successRate"`
+		ChildPolicy         []map[string]json.RawMessage `json:"childPolicy"`
+	}
+	if err := json.Unmarshal(js, &raw); err != nil {
+		return nil, fmt.Errorf("outlier_detection: invalid config %s: %v", js, err)
+	}
+
+	cfg := &Config{
+		MaxEjectionPercent:  DefaultMaxEjectionPercent,
+		ConsecutiveFailures: DefaultConsecutiveFailures,
+		SuccessRate:         raw.SuccessRate,
+	}
+	for _, d := range []struct {
+		name, value string
+		dst         *time.Duration
+		def         time.Duration
+	}{
+		{"interval", raw.Interval, &cfg.Interval, DefaultInterval},
+		{"baseEjectionTime", raw.BaseEjectionTime, &cfg.BaseEjectionTime, DefaultBaseEjectionTime},
+		{"maxEjectionTime", raw.MaxEjectionTime, &cfg.MaxEjectionTime, DefaultMaxEjectionTime},
+	} {
+		*d.dst = d.def
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("outlier_detection: invalid %s %q", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	cfg.MaxEjectionTime = max(cfg.MaxEjectionTime, cfg.BaseEjectionTime)
+
+	if p := raw.MaxEjectionPercent; p != nil {
+		if *p < 0 || *p > 100 {
+			return nil, fmt.Errorf("outlier_detection: maxEjectionPercent %d is not between 0 and 100", *p)
+		}
+		cfg.MaxEjectionPercent = *p
+	}
+	if n := raw.ConsecutiveFailures; n != nil {
+		if *n < 0 {
+			return nil, fmt.Errorf("outlier_detection: consecutiveFailures %d is negative", *n)
+		}
+		cfg.ConsecutiveFailures = *n
+	}
+	if sr := cfg.SuccessRate; sr != nil {
+		if sr.StdevFactor == 0 {
+			sr.StdevFactor = DefaultStdevFactor
+		}
+		if sr.MinimumHosts == 0 {
+			sr.MinimumHosts = DefaultMinimumHosts
+		}
+		if sr.RequestVolume == 0 {
+			sr.RequestVolume = DefaultRequestVolume
+		}
+		if sr.StdevFactor < 0 || sr.MinimumHosts < 1 || sr.RequestVolume < 1 {
+			return nil, fmt.Errorf("outlier_detection: invalid successRate %+v", *sr)
+		}
+	}
+
+	// The first registered policy of the list is used, as gRPC does for
+	// loadBalancingConfig
+	cfg.childName = DefaultChildPolicy
+	if len(raw.ChildPolicy) > 0 {
+		cfg.childName = ""
+	}
+	for _, policy := range raw.ChildPolicy {
+		if len(policy) != 1 {
+			return nil, fmt.Errorf("outlier_detection: childPolicy entries need exactly one policy, not %d", len(policy))
+		}
+		for name, childJS := range policy {
+			b := balancer.Get(name)
+			if b == nil {
+				continue
+			}
+			if parser, ok := b.(balancer.ConfigParser); ok {
+				childCfg, err := parser.ParseConfig(childJS)
+				if err != nil {
+					return nil, fmt.Errorf("outlier_detection: child policy %s: %v", name, err)
+				}
+				cfg.childConfig = childCfg
+			}
+			cfg.childName = name
+		}
+		if cfg.childName != "" {
+			break
+		}
+	}
+	if cfg.childName == "" {
+		return nil, fmt.Errorf("outlier_detection: no registered policy in childPolicy")
+	}
+	return cfg, nil
+}
+
+// Build implements balancer.Builder.
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	b := &odBalancer{
+		cc:        cc,
+		opts:      opts,
+		endpoints: make(map[string]*endpoint),
+		check:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// odBalancer sits between gRPC and the wrapped policy, the child. It hands
+// the child wrapped SubConns, whose state it can override, and wraps the
+// child's pickers to see the result of every RPC.
+type odBalancer struct {
+	cc   balancer.ClientConn
+	opts balancer.BuildOptions
+
+	// childMu serializes the calls into the child: gRPC never calls the
+	// balancer concurrently, but ejections come from another goroutine.
+	childMu   sync.Mutex
+	child     balancer.Balancer
+	childName string
+	closed    bool
+
+	// mu guards the endpoints and the config, also read by NewSubConn and
+	// UpdateState, which the child calls while childMu is held.
+	mu        sync.Mutex
+	cfg       *Config
+	endpoints map[string]*endpoint
+	ticker    *time.Ticker
+
+	check chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// endpoint holds the RPC results of a server, by address, across the
+// SubConns the child creates for it.
+type endpoint struct {
+	addr     string
+	subConns map[*subConn]bool
+
+	// Updated by the pickers, concurrently
+	successes   atomic.Int64
+	failures    atomic.Int64
+	consecutive atomic.Int64
+
+	// Guarded by odBalancer.mu
+	ejected    bool
+	ejectedAt  time.Time
+	ejectedFor time.Duration
+	multiplier int
+}
+
+// UpdateClientConnState implements balancer.Balancer.
+func (b *odBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	cfg, ok := s.BalancerConfig.(*Config)
+	if !ok {
+		parsed, err := builder{}.ParseConfig(json.RawMessage("{}"))
+		if err != nil {
+			return err
+		}
+		cfg = parsed.(*Config)
+	}
+
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+
+	b.mu.Lock()
+	if b.cfg == nil || b.cfg.Interval != cfg.Interval {
+		if b.ticker != nil {
+			b.ticker.Stop()
+		}
+		b.ticker = time.NewTicker(cfg.Interval)
+		select {
+		case b.check <- struct{}{}: // pick up the new ticker
+		default:
+		}
+	}
+	b.cfg = cfg
+
+	// Keep the results of the servers still resolved only
+	resolved := make(map[string]bool)
+	for _, a := range s.ResolverState.Addresses {
+		resolved[a.Addr] = true
+	}
+	for _, e := range s.ResolverState.Endpoints {
+		for _, a := range e.Addresses {
+			resolved[a.Addr] = true
+		}
+	}
+	for addr := range resolved {
+		if b.endpoints[addr] == nil {
+			b.endpoints[addr] = &endpoint{addr: addr, subConns: make(map[*subConn]bool)}
+		}
+	}
+	for addr, ep := range b.endpoints {
+		if !resolved[addr] && len(ep.subConns) == 0 {
+			if ep.ejected {
+				Metrics.Add("ejected", -1)
+			}
+			delete(b.endpoints, addr)
+		}
+	}
+	b.mu.Unlock()
+
+	if b.child == nil || b.childName != cfg.childName {
+		if b.child != nil {
+			b.child.Close()
+		}
+		b.child = balancer.Get(cfg.childName).Build(&wrappedCC{ClientConn: b.cc, b: b}, b.opts)
+		b.childName = cfg.childName
+	}
+	return b.child.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState:  s.ResolverState,
+		BalancerConfig: cfg.childConfig,
+	})
+}
+
+// ResolverError implements balancer.Balancer.
+func (b *odBalancer) ResolverError(err error) {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+	if b.child != nil {
+		b.child.ResolverError(err)
+	}
+}
+
+// UpdateSubConnState implements balancer.Balancer. SubConns report their
+// state through the listener given to NewSubConn instead.
+func (b *odBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+}
+
+// ExitIdle implements balancer.ExitIdler.
+func (b *odBalancer) ExitIdle() {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+	if ei, ok := b.child.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+// Close implements balancer.Balancer.
+func (b *odBalancer) Close() {
+	close(b.done)
+	b.wg.Wait()
+
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+	b.closed = true
+	if b.child != nil {
+		b.child.Close()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ticker != nil {
+		b.ticker.Stop()
+	}
+	for _, ep := range b.endpoints {
+		if ep.ejected {
+			Metrics.Add("ejected", -1)
+		}
+	}
+}
+
+// run evaluates the servers every interval, and checks for consecutive
+// failures when a picker reports one.
+func (b *odBalancer) run() {
+	defer b.wg.Done()
+	for {
+		b.mu.Lock()
+		var tick <-chan time.Time
+		if b.ticker != nil {
+			tick = b.ticker.C
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.done:
+			return
+		case <-b.check:
+			b.evaluate(false)
+		case <-tick:
+			b.evaluate(true)
+		}
+	}
+}
+
+// evaluate ejects the failing servers and brings back those whose time is
+// up. Only at the end of an interval is the success rate checked.
+func (b *odBalancer) evaluate(interval bool) {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+	if b.closed {
+		return
+	}
+
+	// The child learns about the changes once mu is released, as it may
+	// call back into the balancer, e.g. NewSubConn
+	var notify []func()
+	defer func() {
+		for _, f := range notify {
+			f()
+		}
+	}()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil {
+		return
+	}
+	now := time.Now()
+
+	if n := int64(b.cfg.ConsecutiveFailures); n > 0 {
+		for _, ep := range b.endpoints {
+			if c := ep.consecutive.Load(); !ep.ejected && c >= n {
+				notify = append(notify, b.eject(ep, now, "consecutive_failures", fmt.Sprintf("%d consecutive failures", c))...)
+			}
+		}
+	}
+	if !interval {
+		return
+	}
+
+	if sr := b.cfg.SuccessRate; sr != nil {
+		notify = append(notify, b.ejectBySuccessRate(sr, now)...)
+	}
+
+	for _, ep := range b.endpoints {
+		// A new interval counts from zero
+		ep.successes.Store(0)
+		ep.failures.Store(0)
+
+		switch {
+		case ep.ejected && !now.Before(ep.ejectedAt.Add(ep.ejectedFor)):
+			notify = append(notify, b.uneject(ep)...)
+		case !ep.ejected && ep.multiplier > 0:
+			ep.multiplier--
+		}
+	}
+}
+
+// ejectBySuccessRate must be called with b.mu held.
+func (b *odBalancer) ejectBySuccessRate(sr *SuccessRate, now time.Time) []func() {
+	type candidate struct {
+		ep   *endpoint
+		rate float64
+	}
+	var candidates []candidate
+	for _, ep := range b.endpoints {
+		if ep.ejected {
+			continue
+		}
+		ok, failed := ep.successes.Load(), ep.failures.Load()
+		if ok+failed >= int64(sr.RequestVolume) {
+			candidates = append(candidates, candidate{ep, float64(ok) / float64(ok+failed)})
+		}
+	}
+	if len(candidates) < sr.MinimumHosts {
+		return nil
+	}
+
+	var mean, variance float64
+	for _, c := range candidates {
+		mean += c.rate
+	}
+	mean /= float64(len(candidates))
+	for _, c := range candidates {
+		variance += (c.rate - mean) * (c.rate - mean)
+	}
+	threshold := mean - sr.StdevFactor*math.Sqrt(variance/float64(len(candidates)))
+
+	var notify []func()
+	for _, c := range candidates {
+		if c.rate < threshold {
+			notify = append(notify, b.eject(c.ep, now, "success_rate", fmt.Sprintf("success rate %.2f below %.2f", c.rate, threshold))...)
+		}
+	}
+	return notify
+}
+
+// eject takes ep out of rotation, unless too many servers are ejected
+// already, and returns the calls telling the child. The cap is
+// maxEjectionPercent of the servers rounded up, so none with 0. Must be
+// called with b.mu held.
+func (b *odBalancer) eject(ep *endpoint, now time.Time, reason, detail string) []func() {
+	ejected := 0
+	for _, other := range b.endpoints {
+		if other.ejected {
+			ejected++
+		}
+	}
+	if ejected*100 >= b.cfg.MaxEjectionPercent*len(b.endpoints) {
+		logf("outlier detection: not ejecting %s (%s): %d of %d servers ejected already", ep.addr, detail, ejected, len(b.endpoints))
+		return nil
+	}
+
+	// Exponential: the base time doubles with every ejection in a row
+	ep.multiplier++
+	d := b.cfg.BaseEjectionTime
+	for i := 1; i < ep.multiplier && d < b.cfg.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	ep.ejected, ep.ejectedAt, ep.ejectedFor = true, now, min(d, b.cfg.MaxEjectionTime)
+	ep.consecutive.Store(0)
+	Metrics.Add("ejections_"+reason, 1)
+	Metrics.Add("ejected", 1)
+	logf("outlier detection: ejected %s for %v: %s", ep.addr, ep.ejectedFor, detail)
+	return ep.setEjected(true)
+}
+
+// uneject puts ep back in rotation and returns the calls telling the
+// child. Must be called with b.mu held.
+func (b *odBalancer) uneject(ep *endpoint) []func() {
+	ep.ejected = false
+	ep.consecutive.Store(0)
+	Metrics.Add("unejections", 1)
+	Metrics.Add("ejected", -1)
+	logf("outlier detection: %s is back after %v", ep.addr, ep.ejectedFor)
+	return ep.setEjected(false)
+}
+
+func (ep *endpoint) setEjected(ejected bool) []func() {
+	var notify []func()
+	for sc := range ep.subConns {
+		if f := sc.setEjected(ejected); f != nil {
+			notify = append(notify, f)
+		}
+	}
+	return notify
+}
+
+func logf(format string, args ...any) {
+	if Logf != nil {
+		Logf(format, args...)
+	}
+}
+
+// wrappedCC is the ClientConn of the child.
+type wrappedCC struct {
+	balancer.ClientConn
+	b *odBalancer
+}
+
+// NewSubConn wraps the SubConns of the child, to report an ejected server
+// as failed.
+func (cc *wrappedCC) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	if len(addrs) == 0 {
+		return cc.ClientConn.NewSubConn(addrs, opts)
+	}
+	sc := &subConn{listener: opts.StateListener, b: cc.b}
+	opts.StateListener = sc.updateState
+	inner, err := cc.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	sc.SubConn = inner
+
+	cc.b.mu.Lock()
+	defer cc.b.mu.Unlock()
+	ep := cc.b.endpoints[addrs[0].Addr]
+	if ep == nil {
+		ep = &endpoint{addr: addrs[0].Addr, subConns: make(map[*subConn]bool)}
+		cc.b.endpoints[ep.addr] = ep
+	}
+	sc.ep = ep
+	sc.ejected = ep.ejected
+	ep.subConns[sc] = true
+	return sc, nil
+}
+
+// RemoveSubConn unwraps sc for gRPC.
+func (cc *wrappedCC) RemoveSubConn(sc balancer.SubConn) {
+	sc.Shutdown()
+}
+
+// UpdateAddresses unwraps sc for gRPC.
+func (cc *wrappedCC) UpdateAddresses(sc balancer.SubConn, addrs []resolver.Address) {
+	sc.UpdateAddresses(addrs)
+}
+
+// UpdateState wraps the picker of the child.
+func (cc *wrappedCC) UpdateState(s balancer.State) {
+	s.Picker = &picker{child: s.Picker, b: cc.b}
+	cc.ClientConn.UpdateState(s)
+}
+
+// subConn is a SubConn of the child. While its server is ejected, the
+// child sees it failed: through the health listener if the child
+// registered one, as pick_first under round_robin does, otherwise through
+// the state listener.
+type subConn struct {
+	balancer.SubConn
+	b  *odBalancer
+	ep *endpoint
+
+	// Guarded by odBalancer.mu. The listeners are the child's, so they
+	// are called with odBalancer.childMu held.
+	listener       func(balancer.SubConnState)
+	healthListener func(balancer.SubConnState)
+	state          balancer.SubConnState
+	health         balancer.SubConnState
+	ejected        bool
+}
+
+func (sc *subConn) updateState(state balancer.SubConnState) {
+	sc.b.childMu.Lock()
+	defer sc.b.childMu.Unlock()
+
+	sc.b.mu.Lock()
+	sc.state = state
+	forward := !sc.ejected || sc.healthListener != nil || state.ConnectivityState == connectivity.Shutdown
+	if state.ConnectivityState == connectivity.Shutdown {
+		delete(sc.ep.subConns, sc)
+	}
+	sc.b.mu.Unlock()
+
+	if forward && !sc.b.closed {
+		sc.listener(state)
+	}
+}
+
+// RegisterHealthListener implements balancer.SubConn.
+func (sc *subConn) RegisterHealthListener(listener func(balancer.SubConnState)) {
+	sc.b.mu.Lock()
+	sc.healthListener = listener
+	sc.health = balancer.SubConnState{ConnectivityState: connectivity.Connecting}
+	sc.b.mu.Unlock()
+
+	if listener == nil {
+		sc.SubConn.RegisterHealthListener(nil)
+		return
+	}
+	sc.SubConn.RegisterHealthListener(func(state balancer.SubConnState) {
+		sc.b.childMu.Lock()
+		defer sc.b.childMu.Unlock()
+
+		sc.b.mu.Lock()
+		sc.health = state
+		forward := !sc.ejected && sc.healthListener != nil
+		sc.b.mu.Unlock()
+		if forward && !sc.b.closed {
+			listener(state)
+		}
+	})
+}
+
+// setEjected marks the ejection or its end, and returns the call telling
+// the child: the failure, or the state hidden during the ejection. Must be
+// called with odBalancer.mu held.
+func (sc *subConn) setEjected(ejected bool) func() {
+	if sc.ejected == ejected {
+		return nil
+	}
+	sc.ejected = ejected
+
+	listener, state := sc.listener, sc.state
+	if sc.healthListener != nil {
+		listener, state = sc.healthListener, sc.health
+	}
+	if ejected {
+		state = balancer.SubConnState{ConnectivityState: connectivity.TransientFailure, ConnectionError: errEjected}
+	}
+	return func() { listener(state) }
+}
+
+// picker records the result of every RPC picked by the child's picker.
+type picker struct {
+	child balancer.Picker
+	b     *odBalancer
+}
+
+// Pick implements balancer.Picker.
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	res, err := p.child.Pick(info)
+	if err != nil {
+		return res, err
+	}
+	sc, ok := res.SubConn.(*subConn)
+	if !ok {
+		return res, nil
+	}
+	res.SubConn = sc.SubConn
+
+	childDone := res.Done
+	res.Done = func(di balancer.DoneInfo) {
+		if childDone != nil {
+			childDone(di)
+		}
+		ep := sc.ep
+		if !failed(di.Err) {
+			ep.successes.Add(1)
+			ep.consecutive.Store(0)
+			return
+		}
+		ep.failures.Add(1)
+		if n := ep.consecutive.Add(1); n == int64(p.b.consecutiveThreshold()) {
+			select {
+			case p.b.check <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return res, nil
+}
+
+func (b *odBalancer) consecutiveThreshold() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil {
+		return 0
+	}
+	return b.cfg.ConsecutiveFailures
+}
+
+// failed tells whether an RPC error is the server's fault.
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.Unknown, codes.DataLoss, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
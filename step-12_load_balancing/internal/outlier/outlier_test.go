@@ -0,0 +1,251 @@
+package outlier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// childName is a round robin child built on the base balancer, which hears
+// about ejections through the state listener.
+const childName = "outlier_test_round_robin"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(childName, rrPickerBuilder{}, base.Config{}))
+}
+
+type rrPickerBuilder struct{}
+
+func (rrPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &rrPicker{}
+	for sc := range info.ReadySCs {
+		p.scs = append(p.scs, sc)
+	}
+	return p
+}
+
+type rrPicker struct {
+	scs  []balancer.SubConn
+	next atomic.Uint32
+}
+
+func (p *rrPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	n := p.next.Add(1) - 1
+	return balancer.PickResult{SubConn: p.scs[n%uint32(len(p.scs))]}, nil
+}
+
+// fakeCC stands in for the channel. The embedded ClientConn is nil, so any
+// call the test does not expect panics.
+type fakeCC struct {
+	balancer.ClientConn
+
+	mu       sync.Mutex
+	subConns []*fakeSubConn
+	picker   balancer.Picker
+}
+
+func (cc *fakeCC) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	sc := &fakeSubConn{addr: addrs[0].Addr, listener: opts.StateListener}
+	cc.subConns = append(cc.subConns, sc)
+	return sc, nil
+}
+
+func (cc *fakeCC) UpdateState(s balancer.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.picker = s.Picker
+}
+
+// ready reports every SubConn as connected.
+func (cc *fakeCC) ready() {
+	cc.mu.Lock()
+	subConns := slices.Clone(cc.subConns)
+	cc.mu.Unlock()
+	for _, sc := range subConns {
+		sc.listener(balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	}
+}
+
+// rpc picks a server until it gets addr, and ends the RPC with err.
+func (cc *fakeCC) rpc(t *testing.T, addr string, err error) {
+	t.Helper()
+	cc.mu.Lock()
+	p := cc.picker
+	cc.mu.Unlock()
+	for range 100 {
+		res, pickErr := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if pickErr != nil {
+			t.Fatalf("Pick() error = %v", pickErr)
+		}
+		if res.SubConn.(*fakeSubConn).addr == addr {
+			res.Done(balancer.DoneInfo{Err: err})
+			return
+		}
+		res.Done(balancer.DoneInfo{})
+	}
+	t.Fatalf("%s is never picked", addr)
+}
+
+// picked returns the servers picked by n RPCs.
+func (cc *fakeCC) picked(t *testing.T, n int) map[string]bool {
+	t.Helper()
+	cc.mu.Lock()
+	p := cc.picker
+	cc.mu.Unlock()
+	addrs := make(map[string]bool)
+	for range n {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatalf("Pick() error = %v", err)
+		}
+		addrs[res.SubConn.(*fakeSubConn).addr] = true
+		res.Done(balancer.DoneInfo{})
+	}
+	return addrs
+}
+
+type fakeSubConn struct {
+	balancer.SubConn
+	addr     string
+	listener func(balancer.SubConnState)
+}
+
+func (*fakeSubConn) Connect()  {}
+func (*fakeSubConn) Shutdown() {}
+
+var errUnavailable = status.Error(codes.Unavailable, "server down")
+
+// newBalancer returns an outlier detection balancer over addrs, all ready.
+// The interval is long, so only the test ends intervals, by calling
+// evaluate.
+func newBalancer(t *testing.T, addrs []string, config string) (*odBalancer, *fakeCC) {
+	t.Helper()
+	logf := Logf
+	Logf = t.Logf
+	t.Cleanup(func() { Logf = logf })
+
+	cfg, err := builder{}.ParseConfig(json.RawMessage(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &fakeCC{}
+	b := builder{}.Build(cc, balancer.BuildOptions{}).(*odBalancer)
+	t.Cleanup(b.Close)
+
+	var state resolver.State
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	if err := b.UpdateClientConnState(balancer.ClientConnState{ResolverState: state, BalancerConfig: cfg}); err != nil {
+		t.Fatal(err)
+	}
+	cc.ready()
+	return b, cc
+}
+
+func config(maxEjectionPercent int) string {
+	return fmt.Sprintf(`{
+		"interval": "1h", "baseEjectionTime": "100ms", "maxEjectionTime": "1s",
+		"maxEjectionPercent": %d, "consecutiveFailures": 3,
+		"childPolicy": [{%q: {}}]
+	}`, maxEjectionPercent, childName)
+}
+
+func ejected(b *odBalancer) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var addrs []string
+	for addr, ep := range b.endpoints {
+		if ep.ejected {
+			addrs = append(addrs, addr)
+		}
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	b, cc := newBalancer(t, []string{"a:1", "b:1", "c:1"}, config(100))
+
+	// Errors that are the caller's doing count as successes, and a success
+	// resets the count
+	cc.rpc(t, "a:1", errUnavailable)
+	cc.rpc(t, "a:1", errUnavailable)
+	cc.rpc(t, "a:1", status.Error(codes.NotFound, "no such user"))
+	cc.rpc(t, "a:1", errUnavailable)
+	cc.rpc(t, "a:1", errUnavailable)
+	b.evaluate(false)
+	if got := ejected(b); len(got) != 0 {
+		t.Fatalf("ejected %v without 3 consecutive failures", got)
+	}
+
+	cc.rpc(t, "a:1", errUnavailable)
+	b.evaluate(false)
+	if got := ejected(b); !slices.Equal(got, []string{"a:1"}) {
+		t.Fatalf("ejected %v, want [a:1]", got)
+	}
+	if got := cc.picked(t, 20); got["a:1"] || len(got) != 2 {
+		t.Fatalf("picked %v after ejecting a:1, want b:1 and c:1", got)
+	}
+
+	// Still ejected until baseEjectionTime is over
+	b.evaluate(true)
+	if got := ejected(b); !slices.Equal(got, []string{"a:1"}) {
+		t.Fatalf("ejected %v before baseEjectionTime, want [a:1]", got)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	b.evaluate(true)
+	if got := ejected(b); len(got) != 0 {
+		t.Fatalf("ejected %v after baseEjectionTime, want none", got)
+	}
+	if got := cc.picked(t, 20); len(got) != 3 {
+		t.Fatalf("picked %v after a:1 came back, want all 3", got)
+	}
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	tests := []struct {
+		percent int
+		want    int
+	}{
+		{percent: 0, want: 0},
+		{percent: 10, want: 1}, // rounded up
+		{percent: 25, want: 1},
+		{percent: 50, want: 2},
+		{percent: 100, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d%%", tt.percent), func(t *testing.T) {
+			addrs := []string{"a:1", "b:1", "c:1", "d:1"}
+			b, cc := newBalancer(t, addrs, config(tt.percent))
+
+			for _, addr := range addrs {
+				for range 3 {
+					cc.rpc(t, addr, errUnavailable)
+				}
+				b.evaluate(false)
+			}
+			if got := ejected(b); len(got) != tt.want {
+				t.Errorf("ejected %v, want %d servers", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Package registration keeps a server registered with the Registry service
+// for as long as it runs: it registers, renews the lease with heartbeats,
+// registers again if the lease was lost, e.g. because the registry
+// restarted, and deregisters on shutdown.
+package registration
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	registrypb "step-12_load_balancing/internal/registry"
+)
+
+// DefaultLease is the lease requested by default.
+const DefaultLease = 10 * time.Second
+
+// Options configure a Registration.
+type Options struct {
+	// Lease requested from the registry. Defaults to DefaultLease.
+	// Heartbeats are sent three times per granted lease, so a lost
+	// heartbeat or two does not expire the instance.
+	Lease time.Duration
+	// Logf, if set, logs registrations and failed heartbeats.
+	Logf func(format string, args ...any)
+}
+
+// Registration is the registration of an instance.
+type Registration struct {
+	client   registrypb.RegistryClient
+	instance *registrypb.Instance
+	opts     Options
+
+	mu    sync.Mutex
+	id    string
+	lease time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Register registers instance with the registry behind conn and keeps it
+// registered until Deregister. The first registration must succeed;
+// later failures are retried in the background.
+func Register(ctx context.Context, conn grpc.ClientConnInterface, instance *registrypb.Instance, opts Options) (*Registration, error) {
+	if opts.Lease <= 0 {
+		opts.Lease = DefaultLease
+	}
+	if opts.Logf == nil {
+		opts.Logf = func(string, ...any) {}
+	}
+
+	r := &Registration{
+		client:   registrypb.NewRegistryClient(conn),
+		instance: proto.Clone(instance).(*registrypb.Instance),
+		opts:     opts,
+		done:     make(chan struct{}),
+	}
+	if err := r.register(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, r.cancel = context.WithCancel(context.Background())
+	go r.heartbeat(ctx)
+	return r, nil
+}
+
+// ID returns the current ID of the instance.
+func (r *Registration) ID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id
+}
+
+// Deregister stops the heartbeats and removes the instance from the
+// registry, so clients stop sending it requests right away.
+func (r *Registration) Deregister(ctx context.Context) error {
+	r.cancel()
+	<-r.done
+
+	_, err := r.client.Deregister(ctx, &registrypb.DeregisterRequest{Id: r.ID()})
+	return err
+}
+
+func (r *Registration) register(ctx context.Context) error {
+	resp, err := r.client.Register(ctx, &registrypb.RegisterRequest{
+		Instance: r.instance,
+		Lease:    durationpb.New(r.opts.Lease),
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.id, r.lease = resp.GetId(), resp.GetLease().AsDuration()
+	r.mu.Unlock()
+	r.opts.Logf("Registered as %s instance %s with a %v lease", r.instance.Service, resp.GetId(), resp.GetLease().AsDuration())
+	return nil
+}
+
+func (r *Registration) heartbeat(ctx context.Context) {
+	defer close(r.done)
+
+	for {
+		r.mu.Lock()
+		interval := r.lease / 3
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		_, err := r.client.Heartbeat(ctx, &registrypb.HeartbeatRequest{Id: r.ID()})
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return
+		case status.Code(err) == codes.NotFound:
+			// The lease expired; register again
+			r.opts.Logf("Registration %s lost, registering again", r.ID())
+			if err := r.register(ctx); err != nil {
+				r.opts.Logf("Failed to register again: %v", err)
+			}
+		default:
+			// Retried on the next tick, within the lease
+			r.opts.Logf("Heartbeat failed: %v", err)
+		}
+	}
+}
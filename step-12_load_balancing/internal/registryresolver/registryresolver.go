@@ -0,0 +1,159 @@
+// Package registryresolver resolves targets like
+// registry://localhost:50100/greeter from the Registry service: the
+// authority is the registry and the path the service. The resolver keeps a
+// WatchService stream open and pushes every membership change to the
+// channel, with zones, weights and priorities set through package addrattr.
+package registryresolver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+
+	"step-12_load_balancing/internal/addrattr"
+	registrypb "step-12_load_balancing/internal/registry"
+)
+
+// Scheme is the scheme of the targets handled by this resolver.
+const Scheme = "registry"
+
+// Reconnection backoff after the watch stream breaks.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// Builder builds registry resolvers.
+type Builder struct {
+	// DialOptions for the connection to the registry. Defaults to an
+	// insecure connection.
+	DialOptions []grpc.DialOption
+	// OnUpdate, if set, is called with the instances pushed to a channel,
+	// or with the error reported to it.
+	OnUpdate func(service string, instances []*registrypb.Instance, err error)
+}
+
+// Build implements resolver.Builder.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	registry := target.URL.Host
+	service := strings.TrimPrefix(target.URL.Path, "/")
+	if registry == "" || service == "" {
+		return nil, fmt.Errorf("registryresolver: target %q is not registry://<registry>/<service>", target.URL.String())
+	}
+
+	dialOpts := b.DialOptions
+	if len(dialOpts) == 0 {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.NewClient(registry, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("registryresolver: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &registryResolver{
+		service:  service,
+		cc:       cc,
+		conn:     conn,
+		client:   registrypb.NewRegistryClient(conn),
+		onUpdate: b.OnUpdate,
+		cancel:   cancel,
+	}
+	r.wg.Add(1)
+	go r.watch(ctx)
+	return r, nil
+}
+
+// Scheme implements resolver.Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+type registryResolver struct {
+	service  string
+	cc       resolver.ClientConn
+	conn     *grpc.ClientConn
+	client   registrypb.RegistryClient
+	onUpdate func(service string, instances []*registrypb.Instance, err error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// ResolveNow implements resolver.Resolver. Changes are pushed by the
+// registry as they happen, so there is nothing to do.
+func (r *registryResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+// Close implements resolver.Resolver.
+func (r *registryResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+	r.conn.Close()
+}
+
+// watch follows the instances of the service, reconnecting to the registry
+// with exponential backoff when the stream breaks.
+func (r *registryResolver) watch(ctx context.Context) {
+	defer r.wg.Done()
+
+	backoff := minBackoff
+	for {
+		received, err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		r.cc.ReportError(fmt.Errorf("registryresolver: watching %s: %v", r.service, err))
+		if r.onUpdate != nil {
+			r.onUpdate(r.service, nil, err)
+		}
+
+		if received {
+			backoff = minBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// follow pushes the snapshots of one WatchService stream until it breaks.
+// It reports whether any snapshot was received.
+func (r *registryResolver) follow(ctx context.Context) (bool, error) {
+	stream, err := r.client.WatchService(ctx, &registrypb.WatchServiceRequest{Service: r.service})
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		snapshot, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+
+		addrs := make([]resolver.Address, 0, len(snapshot.GetInstances()))
+		for _, in := range snapshot.GetInstances() {
+			addr := resolver.Address{Addr: in.GetAddress()}
+			addr = addrattr.WithZone(addr, in.GetZone())
+			addr = addrattr.WithWeight(addr, in.GetWeight())
+			addr = addrattr.WithPriority(addr, in.GetPriority())
+			addrs = append(addrs, addr)
+		}
+		// An empty list is pushed too: clients should fail rather than
+		// keep calling instances that left
+		r.cc.UpdateState(resolver.State{Addresses: addrs})
+		if r.onUpdate != nil {
+			r.onUpdate(r.service, snapshot.GetInstances(), nil)
+		}
+	}
+}
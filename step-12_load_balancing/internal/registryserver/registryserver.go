@@ -0,0 +1,282 @@
+// Package registryserver implements the Registry service: a small,
+// in-memory service registry for local and test environments, standing in
+// for Consul. Instances register with a lease, renew it with heartbeats and
+// expire when they stop. Watchers get the full list of instances of a
+// service after every change.
+package registryserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	registrypb "step-12_load_balancing/internal/registry"
+)
+
+// Defaults of Options.
+const (
+	DefaultLease         = 10 * time.Second
+	DefaultMaxLease      = time.Minute
+	DefaultSweepInterval = time.Second
+)
+
+// minLease keeps heartbeats from flooding the registry.
+const minLease = time.Second
+
+// Options configure a Server.
+type Options struct {
+	// DefaultLease is granted to instances that do not ask for a lease.
+	DefaultLease time.Duration
+	// MaxLease caps the requested leases, so a crashed instance does not
+	// linger for long.
+	MaxLease time.Duration
+	// SweepInterval is how often expired leases are looked for.
+	SweepInterval time.Duration
+	// Logf, if set, logs registrations, deregistrations and expirations.
+	Logf func(format string, args ...any)
+}
+
+// Server is a registrypb.RegistryServer. Close it to stop expiring leases.
+type Server struct {
+	registrypb.UnimplementedRegistryServer
+	opts Options
+
+	mu       sync.Mutex
+	services map[string]map[string]*entry          // service -> id -> entry
+	watchers map[string]map[chan struct{}]struct{} // service -> watchers
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type entry struct {
+	instance *registrypb.Instance
+	lease    time.Duration
+	expires  time.Time
+}
+
+// New returns a Server, expiring leases in the background.
+func New(opts Options) *Server {
+	if opts.DefaultLease <= 0 {
+		opts.DefaultLease = DefaultLease
+	}
+	if opts.MaxLease <= 0 {
+		opts.MaxLease = DefaultMaxLease
+	}
+	if opts.SweepInterval <= 0 {
+		opts.SweepInterval = DefaultSweepInterval
+	}
+	if opts.Logf == nil {
+		opts.Logf = func(string, ...any) {}
+	}
+
+	s := &Server{
+		opts:     opts,
+		services: make(map[string]map[string]*entry),
+		watchers: make(map[string]map[chan struct{}]struct{}),
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.sweep()
+	return s
+}
+
+// Close stops expiring leases.
+func (s *Server) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// Register implements registrypb.RegistryServer. An instance registering
+// an address already registered for the service replaces it, e.g. after
+// a restart.
+func (s *Server) Register(ctx context.Context, req *registrypb.RegisterRequest) (*registrypb.RegisterResponse, error) {
+	in := req.GetInstance()
+	if in.GetService() == "" {
+		return nil, status.Error(codes.InvalidArgument, "instance has no service")
+	}
+	if _, _, err := net.SplitHostPort(in.GetAddress()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid instance address: %v", err)
+	}
+
+	lease := s.opts.DefaultLease
+	if req.GetLease() != nil {
+		lease = req.GetLease().AsDuration()
+	}
+	lease = min(max(lease, minLease), s.opts.MaxLease)
+
+	instance := proto.Clone(in).(*registrypb.Instance)
+	instance.Id = newID()
+	if instance.Weight == 0 {
+		instance.Weight = 1
+	}
+
+	s.mu.Lock()
+	instances := s.services[instance.Service]
+	if instances == nil {
+		instances = make(map[string]*entry)
+		s.services[instance.Service] = instances
+	}
+	for id, e := range instances {
+		if e.instance.Address == instance.Address {
+			delete(instances, id)
+		}
+	}
+	instances[instance.Id] = &entry{instance: instance, lease: lease, expires: time.Now().Add(lease)}
+	s.notifyLocked(instance.Service)
+	s.mu.Unlock()
+
+	s.opts.Logf("Registered %s instance %s at %s (zone %q, weight %d, priority %d, lease %v)",
+		instance.Service, instance.Id, instance.Address, instance.Zone, instance.Weight, instance.Priority, lease)
+	return &registrypb.RegisterResponse{Id: instance.Id, Lease: durationpb.New(lease)}, nil
+}
+
+// Heartbeat implements registrypb.RegistryServer. The lease is renewed for
+// its original length.
+func (s *Server) Heartbeat(ctx context.Context, req *registrypb.HeartbeatRequest) (*registrypb.HeartbeatResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.findLocked(req.GetId())
+	if e == nil {
+		return nil, status.Errorf(codes.NotFound, "instance %q is not registered", req.GetId())
+	}
+	e.expires = time.Now().Add(e.lease)
+	return &registrypb.HeartbeatResponse{Lease: durationpb.New(e.lease)}, nil
+}
+
+// Deregister implements registrypb.RegistryServer. Deregistering an
+// unknown instance succeeds, so retries are safe.
+func (s *Server) Deregister(ctx context.Context, req *registrypb.DeregisterRequest) (*registrypb.DeregisterResponse, error) {
+	s.mu.Lock()
+	e := s.findLocked(req.GetId())
+	if e != nil {
+		delete(s.services[e.instance.Service], e.instance.Id)
+		s.notifyLocked(e.instance.Service)
+	}
+	s.mu.Unlock()
+
+	if e != nil {
+		s.opts.Logf("Deregistered %s instance %s at %s", e.instance.Service, e.instance.Id, e.instance.Address)
+	}
+	return &registrypb.DeregisterResponse{}, nil
+}
+
+// WatchService implements registrypb.RegistryServer.
+func (s *Server) WatchService(req *registrypb.WatchServiceRequest, stream registrypb.Registry_WatchServiceServer) error {
+	service := req.GetService()
+	if service == "" {
+		return status.Error(codes.InvalidArgument, "no service to watch")
+	}
+
+	changed := make(chan struct{}, 1)
+	s.mu.Lock()
+	if s.watchers[service] == nil {
+		s.watchers[service] = make(map[chan struct{}]struct{})
+	}
+	s.watchers[service][changed] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers[service], changed)
+		if len(s.watchers[service]) == 0 {
+			delete(s.watchers, service)
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		if err := stream.Send(s.snapshot(service)); err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, "registry shutting down")
+		}
+	}
+}
+
+// snapshot lists the instances of service, sorted by address.
+func (s *Server) snapshot(service string) *registrypb.ServiceInstances {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &registrypb.ServiceInstances{}
+	for _, e := range s.services[service] {
+		resp.Instances = append(resp.Instances, proto.Clone(e.instance).(*registrypb.Instance))
+	}
+	sort.Slice(resp.Instances, func(i, j int) bool {
+		return resp.Instances[i].Address < resp.Instances[j].Address
+	})
+	return resp
+}
+
+// sweep expires the instances whose lease ran out.
+func (s *Server) sweep() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			var expired []*registrypb.Instance
+			s.mu.Lock()
+			for service, instances := range s.services {
+				for id, e := range instances {
+					if now.After(e.expires) {
+						delete(instances, id)
+						expired = append(expired, e.instance)
+						s.notifyLocked(service)
+					}
+				}
+			}
+			s.mu.Unlock()
+
+			for _, in := range expired {
+				s.opts.Logf("Expired %s instance %s at %s: no heartbeat", in.Service, in.Id, in.Address)
+			}
+		}
+	}
+}
+
+func (s *Server) findLocked(id string) *entry {
+	for _, instances := range s.services {
+		if e, ok := instances[id]; ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// notifyLocked wakes up the watchers of service. A watcher already due to
+// send a snapshot needs no second wake-up.
+func (s *Server) notifyLocked(service string) {
+	for ch := range s.watchers[service] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
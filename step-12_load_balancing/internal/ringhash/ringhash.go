@@ -0,0 +1,280 @@
+// Package ringhash is a consistent hashing load balancing policy, for
+// affinity: RPCs with the same key, such as a user ID or a chat room, go to
+// the same server as long as it is ready.
+//
+// Every server is placed on a hash ring at many points. An RPC goes to the
+// server of the first point at or after the hash of its key. When a server
+// joins or leaves, only the keys next to its points move, about 1/n of
+// them; the others keep their server.
+//
+// The key is the first of these that is set:
+//   - a key from NewContext, or from the Key call option together with
+//     the client interceptors of this package
+//   - the first outgoing metadata value among hashKeys, by default
+//     x-user-id then x-room-id
+//
+// RPCs without a key are spread round robin.
+//
+//	{"loadBalancingConfig": [{"ring_hash": {"hashKeys": ["x-room-id"], "virtualNodes": 100}}]}
+//
+// Importing the package registers the policy.
+package ringhash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the name of the policy in service configs.
+const Name = "ring_hash"
+
+// DefaultVirtualNodes is the number of points of each server on the ring.
+// More points spread the keys more evenly.
+const DefaultVirtualNodes = 100
+
+// maxVirtualNodes bounds the size of the ring per server.
+const maxVirtualNodes = 10000
+
+// DefaultHashKeys are the metadata keys read when the config names none.
+var DefaultHashKeys = []string{"x-user-id", "x-room-id"}
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// Config is the configuration of the policy.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// HashKeys are the metadata keys of the hash key, in order of
+	// preference.
+	HashKeys []string `json:"hashKeys"`
+	// VirtualNodes is the number of points of each server on the ring.
+	VirtualNodes int `json:"virtualNodes"`
+}
+
+type keyCtxKey struct{}
+
+// NewContext returns a copy of ctx whose RPCs are hashed by key, whatever
+// their metadata.
+func NewContext(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyCtxKey{}, key)
+}
+
+// FromContext returns the key set by NewContext.
+func FromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(keyCtxKey{}).(string)
+	return key, ok && key != ""
+}
+
+type keyOption struct {
+	grpc.EmptyCallOption
+	key string
+}
+
+// Key is a call option hashing the RPC by key. Pickers only see the
+// context of an RPC, so the channel needs UnaryClientInterceptor and
+// StreamClientInterceptor to move the key there.
+func Key(key string) grpc.CallOption {
+	return keyOption{key: key}
+}
+
+func withKeyOption(ctx context.Context, opts []grpc.CallOption) context.Context {
+	for _, opt := range opts {
+		if k, ok := opt.(keyOption); ok {
+			ctx = NewContext(ctx, k.key)
+		}
+	}
+	return ctx
+}
+
+// UnaryClientInterceptor applies the Key call option.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(withKeyOption(ctx, opts), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor applies the Key call option.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withKeyOption(ctx, opts), desc, cc, method, opts...)
+	}
+}
+
+type builder struct{}
+
+// Name implements balancer.Builder.
+func (builder) Name() string {
+	return Name
+}
+
+// Build implements balancer.Builder. The base balancer manages the
+// connections; each channel gets its own picker builder, for its config.
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{cfg: &Config{HashKeys: DefaultHashKeys, VirtualNodes: DefaultVirtualNodes}}
+	return &ringBalancer{
+		Balancer: base.NewBalancerBuilder(Name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &Config{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, fmt.Errorf("ring_hash: invalid config %s: %v", js, err)
+	}
+	for i, k := range cfg.HashKeys {
+		// Metadata keys are lowercase
+		k = strings.ToLower(k)
+		if k == "" || strings.HasPrefix(k, ":") || strings.HasSuffix(k, "-bin") {
+			return nil, fmt.Errorf("ring_hash: hash key %q is not a text metadata key", cfg.HashKeys[i])
+		}
+		cfg.HashKeys[i] = k
+	}
+	if len(cfg.HashKeys) == 0 {
+		cfg.HashKeys = DefaultHashKeys
+	}
+	switch {
+	case cfg.VirtualNodes == 0:
+		cfg.VirtualNodes = DefaultVirtualNodes
+	case cfg.VirtualNodes < 0 || cfg.VirtualNodes > maxVirtualNodes:
+		return nil, fmt.Errorf("ring_hash: virtualNodes %d is not between 1 and %d", cfg.VirtualNodes, maxVirtualNodes)
+	}
+	return cfg, nil
+}
+
+type ringBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+// UpdateClientConnState hands the config to the picker builder before the
+// base balancer builds a picker.
+func (b *ringBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*Config); ok {
+		b.pb.cfg = cfg
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// ExitIdle implements balancer.ExitIdler.
+func (b *ringBalancer) ExitIdle() {
+	if ei, ok := b.Balancer.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+type pickerBuilder struct {
+	cfg *Config
+}
+
+// point is a place on the ring, owned by a server.
+type point struct {
+	hash    uint64
+	backend int
+}
+
+// Build implements base.PickerBuilder. Only ready servers are on the ring,
+// so the keys of a server that goes down move to its neighbours, and come
+// back when it is ready again.
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &picker{hashKeys: pb.cfg.HashKeys}
+	type ready struct {
+		addr string
+		sc   balancer.SubConn
+	}
+	readySCs := make([]ready, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		readySCs = append(readySCs, ready{addr: sci.Address.Addr, sc: sc})
+	}
+	// Sorted, so ties on the ring and the round robin order are the same
+	// in every client
+	sort.Slice(readySCs, func(i, j int) bool { return readySCs[i].addr < readySCs[j].addr })
+
+	// Points hash the address, not the connection, so all clients build
+	// the same ring
+	p.ring = make([]point, 0, len(readySCs)*pb.cfg.VirtualNodes)
+	for i, r := range readySCs {
+		p.scs = append(p.scs, r.sc)
+		for v := 0; v < pb.cfg.VirtualNodes; v++ {
+			p.ring = append(p.ring, point{hash: hash(r.addr + "_" + strconv.Itoa(v)), backend: i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		if p.ring[i].hash != p.ring[j].hash {
+			return p.ring[i].hash < p.ring[j].hash
+		}
+		return p.ring[i].backend < p.ring[j].backend
+	})
+	return p
+}
+
+type picker struct {
+	hashKeys []string
+	scs      []balancer.SubConn
+	ring     []point
+	next     atomic.Uint32
+}
+
+// Pick implements balancer.Picker.
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	key, ok := p.key(info.Ctx)
+	if !ok {
+		n := p.next.Add(1) - 1
+		return balancer.PickResult{SubConn: p.scs[n%uint32(len(p.scs))]}, nil
+	}
+
+	h := hash(key)
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return balancer.PickResult{SubConn: p.scs[p.ring[i].backend]}, nil
+}
+
+func (p *picker) key(ctx context.Context) (string, bool) {
+	if key, ok := FromContext(ctx); ok {
+		return key, true
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for _, k := range p.hashKeys {
+		if vals := md.Get(k); len(vals) > 0 && vals[0] != "" {
+			// The name of the metadata key keeps user "42" and room "42"
+			// apart
+			return k + "=" + vals[0], true
+		}
+	}
+	return "", false
+}
+
+// hash is FNV-1a, mixed with the finalizer of SplitMix64 so similar
+// strings such as "user-1" and "user-2" land far apart.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,275 @@
+// Package wrr is a weighted round robin load balancing policy. Each ready
+// server gets a share of the RPCs proportional to its weight, spread out
+// evenly with the smooth weighted round robin of nginx: weights 5, 1, 1
+// pick a a b a c a a rather than a a a a a b c.
+//
+// Weights come from the resolver, through addrattr.Weight. With
+// enableServerLoad set, servers that report their utilization through
+// package loadreport are weighted by its inverse instead, so a server
+// twice as busy gets half the traffic:
+//
+//	{"loadBalancingConfig": [{"wrr": {"enableServerLoad": true, "weightExpirationPeriod": "10s"}}]}
+//
+// Importing the package registers the policy.
+package wrr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"step-12_load_balancing/internal/addrattr"
+	"step-12_load_balancing/internal/loadreport"
+)
+
+// Name is the name of the policy in service configs.
+const Name = "wrr"
+
+// DefaultWeightExpirationPeriod is how long a reported load is used
+// without a newer one.
+const DefaultWeightExpirationPeriod = 10 * time.Second
+
+// minUtilization caps the weight of idle servers, which report 0.
+const minUtilization = 0.01
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// Config is the configuration of the policy.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// EnableServerLoad weighs servers by the utilization they report
+	// instead of by the weights from the resolver.
+	EnableServerLoad bool
+	// WeightExpirationPeriod is how long a reported load stays valid.
+	// A server without a valid one gets the mean weight of those with one.
+	WeightExpirationPeriod time.Duration
+}
+
+type builder struct{}
+
+// Name implements balancer.Builder.
+func (builder) Name() string {
+	return Name
+}
+
+// Build implements balancer.Builder. The base balancer manages the
+// connections; each channel gets its own picker builder, which keeps the
+// reported loads across pickers.
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{
+		cfg:    &Config{WeightExpirationPeriod: DefaultWeightExpirationPeriod},
+		latest: resolver.NewAddressMapV2[resolver.Address](),
+		loads:  make(map[balancer.SubConn]*load),
+	}
+	return &wrrBalancer{
+		Balancer: base.NewBalancerBuilder(Name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var raw struct {
+		EnableServerLoad       bool   `json:"enableServerLoad"`
+		WeightExpirationPeriod string `json:"weightExpirationPeriod"`
+	}
+	if err := json.Unmarshal(js, &raw); err != nil {
+		return nil, fmt.Errorf("wrr: invalid config %s: %v", js, err)
+	}
+	cfg := &Config{
+		EnableServerLoad:       raw.EnableServerLoad,
+		WeightExpirationPeriod: DefaultWeightExpirationPeriod,
+	}
+	if raw.WeightExpirationPeriod != "" {
+		d, err := time.ParseDuration(raw.WeightExpirationPeriod)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("wrr: invalid weightExpirationPeriod %q", raw.WeightExpirationPeriod)
+		}
+		cfg.WeightExpirationPeriod = d
+	}
+	return cfg, nil
+}
+
+type wrrBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+// UpdateClientConnState hands the config and the addresses to the picker
+// builder before the base balancer builds a picker. The base balancer
+// keeps the addresses it created connections with, so without the latest
+// ones a weight changed by the resolver would be ignored.
+func (b *wrrBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*Config); ok {
+		b.pb.cfg = cfg
+	}
+	b.pb.latest = resolver.NewAddressMapV2[resolver.Address]()
+	for _, addr := range s.ResolverState.Addresses {
+		b.pb.latest.Set(addr, addr)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// ExitIdle implements balancer.ExitIdler.
+func (b *wrrBalancer) ExitIdle() {
+	if ei, ok := b.Balancer.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+// pickerBuilder is only used by its balancer, which never calls it
+// concurrently.
+type pickerBuilder struct {
+	cfg    *Config
+	latest *resolver.AddressMapV2[resolver.Address]
+	loads  map[balancer.SubConn]*load
+}
+
+// Build implements base.PickerBuilder.
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &picker{cfg: pb.cfg}
+	loads := make(map[balancer.SubConn]*load, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		addr := sci.Address
+		if latest, ok := pb.latest.Get(addr); ok {
+			addr = latest
+		}
+		l, ok := pb.loads[sc]
+		if !ok {
+			l = &load{}
+		}
+		loads[sc] = l
+		p.backends = append(p.backends, &backend{
+			sc:     sc,
+			weight: float64(addrattr.Weight(addr)),
+			load:   l,
+		})
+	}
+	// Forget the loads of servers that are gone or not ready
+	pb.loads = loads
+	p.current = make([]float64, len(p.backends))
+	return p
+}
+
+type backend struct {
+	sc     balancer.SubConn
+	weight float64 // from the resolver
+	load   *load
+}
+
+// load is the last utilization reported by a server, shared by the
+// pickers of the channel.
+type load struct {
+	mu      sync.Mutex
+	weight  float64
+	updated time.Time
+}
+
+func (l *load) update(utilization float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.weight = 1 / math.Max(utilization, minUtilization)
+	l.updated = time.Now()
+}
+
+func (l *load) get(now time.Time, expiration time.Duration) (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.updated.IsZero() || now.Sub(l.updated) > expiration {
+		return 0, false
+	}
+	return l.weight, true
+}
+
+type picker struct {
+	cfg      *Config
+	backends []*backend
+
+	mu      sync.Mutex
+	current []float64
+	weights []float64
+}
+
+// Pick implements balancer.Picker with smooth weighted round robin: every
+// backend earns its weight, the richest is picked and pays the total.
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	weights := p.currentWeights()
+	best, total := 0, 0.0
+	for i, w := range weights {
+		p.current[i] += w
+		total += w
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= total
+	p.mu.Unlock()
+
+	b := p.backends[best]
+	res := balancer.PickResult{SubConn: b.sc}
+	if p.cfg.EnableServerLoad {
+		res.Done = func(info balancer.DoneInfo) {
+			if u, ok := loadreport.FromTrailer(info.Trailer); ok {
+				b.load.update(u)
+			}
+		}
+	}
+	return res, nil
+}
+
+// currentWeights returns the weight of every backend. Without server load,
+// or until a server reports one, these are the weights from the resolver.
+// Must be called with p.mu held.
+func (p *picker) currentWeights() []float64 {
+	if p.weights == nil {
+		p.weights = make([]float64, len(p.backends))
+	}
+	if !p.cfg.EnableServerLoad {
+		for i, b := range p.backends {
+			p.weights[i] = b.weight
+		}
+		return p.weights
+	}
+
+	now := time.Now()
+	sum, n := 0.0, 0
+	for i, b := range p.backends {
+		w, ok := b.load.get(now, p.cfg.WeightExpirationPeriod)
+		if !ok {
+			w = 0
+		} else {
+			sum += w
+			n++
+		}
+		p.weights[i] = w
+	}
+	if n == 0 {
+		for i, b := range p.backends {
+			p.weights[i] = b.weight
+		}
+		return p.weights
+	}
+	// Servers yet to report get the mean, so they still get traffic
+	mean := sum / float64(n)
+	for i := range p.weights {
+		if p.weights[i] == 0 {
+			p.weights[i] = mean
+		}
+	}
+	return p.weights
+}
@@ -0,0 +1,276 @@
+// Package zoneaware is a locality aware load balancing policy: it keeps
+// RPCs in the zone of the client, and fails over to other zones and to
+// lower priorities as healthy servers run out.
+//
+// Servers are grouped by priority, from addrattr.Priority, and within a
+// priority into the local zone and the other zones, from addrattr.Zone.
+// A group whose healthy fraction, ready servers over resolved ones, is at
+// least spilloverThreshold takes all the traffic left to it. Below, it
+// takes a proportional part, healthy fraction / spilloverThreshold, and
+// the rest spills over: from the local zone to the other zones of the
+// priority, and from a priority to the next. Spilling gradually keeps the
+// remaining local servers from being overloaded. Within a group, servers
+// are picked round robin.
+//
+// The zone of the client is localZone from the config or, if unset, the
+// CLIENT_ZONE environment variable. Without one, zones are ignored.
+//
+//	{"loadBalancingConfig": [{"zone_aware": {"localZone": "zone-a", "spilloverThreshold": 0.7}}]}
+//
+// Importing the package registers the policy.
+package zoneaware
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	"step-12_load_balancing/internal/addrattr"
+)
+
+// Name is the name of the policy in service configs.
+const Name = "zone_aware"
+
+// EnvZone is the environment variable with the zone of the client.
+const EnvZone = "CLIENT_ZONE"
+
+// DefaultSpilloverThreshold is the healthy fraction below which a group
+// starts spilling traffic over.
+const DefaultSpilloverThreshold = 0.7
+
+// Logf logs the share of the traffic of each group when it changes. Set it
+// to nil for silence.
+var Logf = log.Printf
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// Config is the configuration of the policy.
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// LocalZone is the zone of the client, CLIENT_ZONE if empty.
+	LocalZone string `json:"localZone"`
+	// SpilloverThreshold is the healthy fraction, in (0, 1], below which
+	// a group spills traffic over.
+	SpilloverThreshold float64 `json:"spilloverThreshold"`
+}
+
+type builder struct{}
+
+// Name implements balancer.Builder.
+func (builder) Name() string {
+	return Name
+}
+
+// Build implements balancer.Builder. The base balancer manages the
+// connections; each channel gets its own picker builder, for its config
+// and addresses.
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{
+		cfg:    &Config{LocalZone: os.Getenv(EnvZone), SpilloverThreshold: DefaultSpilloverThreshold},
+		latest: resolver.NewAddressMapV2[resolver.Address](),
+	}
+	return &zoneBalancer{
+		Balancer: base.NewBalancerBuilder(Name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// ParseConfig implements balancer.ConfigParser.
+func (builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &Config{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, fmt.Errorf("zone_aware: invalid config %s: %v", js, err)
+	}
+	if cfg.LocalZone == "" {
+		cfg.LocalZone = os.Getenv(EnvZone)
+	}
+	switch {
+	case cfg.SpilloverThreshold == 0:
+		cfg.SpilloverThreshold = DefaultSpilloverThreshold
+	case !(cfg.SpilloverThreshold > 0 && cfg.SpilloverThreshold <= 1):
+		return nil, fmt.Errorf("zone_aware: spilloverThreshold %v is not in (0, 1]", cfg.SpilloverThreshold)
+	}
+	return cfg, nil
+}
+
+type zoneBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+// UpdateClientConnState hands the config and the addresses to the picker
+// builder before the base balancer builds a picker. Healthy fractions need
+// all the addresses, not only the ready ones the picker builder gets, and
+// the base balancer would keep stale zones and priorities.
+func (b *zoneBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*Config); ok {
+		b.pb.cfg = cfg
+	}
+	b.pb.latest = resolver.NewAddressMapV2[resolver.Address]()
+	for _, addr := range s.ResolverState.Addresses {
+		b.pb.latest.Set(addr, addr)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// ExitIdle implements balancer.ExitIdler.
+func (b *zoneBalancer) ExitIdle() {
+	if ei, ok := b.Balancer.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+// pickerBuilder is only used by its balancer, which never calls it
+// concurrently.
+type pickerBuilder struct {
+	cfg    *Config
+	latest *resolver.AddressMapV2[resolver.Address]
+	// last is the description of the last picker, to log changes only
+	last string
+}
+
+// groupKey identifies a group of servers.
+type groupKey struct {
+	priority uint32
+	local    bool
+}
+
+type group struct {
+	resolved int
+	ready    []balancer.SubConn
+}
+
+// Build implements base.PickerBuilder.
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	localZone := pb.cfg.LocalZone
+	key := func(addr resolver.Address) groupKey {
+		return groupKey{
+			priority: addrattr.Priority(addr),
+			local:    localZone == "" || addrattr.Zone(addr) == localZone,
+		}
+	}
+	groups := make(map[groupKey]*group)
+	getGroup := func(k groupKey) *group {
+		g := groups[k]
+		if g == nil {
+			g = &group{}
+			groups[k] = g
+		}
+		return g
+	}
+	for _, addr := range pb.latest.Values() {
+		getGroup(key(addr)).resolved++
+	}
+	for sc, sci := range info.ReadySCs {
+		addr := sci.Address
+		if latest, ok := pb.latest.Get(addr); ok {
+			addr = latest
+		}
+		g := getGroup(key(addr))
+		g.ready = append(g.ready, sc)
+		// A server the resolver dropped may still be ready for a moment
+		g.resolved = max(g.resolved, len(g.ready))
+	}
+
+	var priorities []uint32
+	for k := range groups {
+		if !slices.Contains(priorities, k.priority) {
+			priorities = append(priorities, k.priority)
+		}
+	}
+	slices.Sort(priorities)
+
+	// Each priority takes its part of what the higher ones left: the local
+	// zone first, then the other zones from what the local zone spills
+	p := &picker{}
+	type share struct {
+		prio  uint32
+		name  string
+		g     *group
+		share float64
+	}
+	var shares []share
+	remaining := 1.0
+	for _, prio := range priorities {
+		local, other := groups[groupKey{prio, true}], groups[groupKey{prio, false}]
+		takeLocal := pb.take(local)
+		takeOther := (1 - takeLocal) * pb.take(other)
+		shares = append(shares,
+			share{prio, "local", local, remaining * takeLocal},
+			share{prio, "other zones", other, remaining * takeOther},
+		)
+		remaining -= remaining * (takeLocal + takeOther)
+	}
+
+	// Not enough healthy servers anywhere: the ready ones share it all
+	total := 1 - remaining
+	var desc []string
+	for _, sh := range shares {
+		if sh.share <= 0 {
+			continue
+		}
+		p.cumulative += sh.share / total
+		p.buckets = append(p.buckets, &bucket{scs: sh.g.ready, cumulative: p.cumulative})
+		desc = append(desc, fmt.Sprintf("priority %d %s %d/%d ready %.0f%%", sh.prio, sh.name, len(sh.g.ready), sh.g.resolved, sh.share/total*100))
+	}
+
+	if d := strings.Join(desc, ", "); d != pb.last {
+		pb.last = d
+		if Logf != nil {
+			Logf("zone-aware (zone %q): %s", localZone, d)
+		}
+	}
+	return p
+}
+
+// take is the part of the traffic left to g that it takes, up to 1.
+func (pb *pickerBuilder) take(g *group) float64 {
+	if g == nil || g.resolved == 0 || len(g.ready) == 0 {
+		return 0
+	}
+	healthy := float64(len(g.ready)) / float64(g.resolved)
+	return min(1, healthy/pb.cfg.SpilloverThreshold)
+}
+
+// bucket is a group of ready servers with its share of the traffic.
+type bucket struct {
+	scs        []balancer.SubConn
+	cumulative float64
+	next       atomic.Uint32
+}
+
+type picker struct {
+	buckets    []*bucket
+	cumulative float64 // 1, give or take rounding
+}
+
+// Pick implements balancer.Picker.
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	r := rand.Float64() * p.cumulative
+	b := p.buckets[len(p.buckets)-1]
+	for _, candidate := range p.buckets {
+		if r < candidate.cumulative {
+			b = candidate
+			break
+		}
+	}
+	n := b.next.Add(1) - 1
+	return balancer.PickResult{SubConn: b.scs[n%uint32(len(b.scs))]}, nil
+}
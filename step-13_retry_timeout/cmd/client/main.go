@@ -12,6 +12,7 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
 
+	"step-13_retry_timeout/internal/diagnostics"
 	greeterpb "step-13_retry_timeout/internal/greeter"
 )
 
@@ -25,6 +26,21 @@ const (
 	defaultTimeout = 3 * time.Second
 )
 
+// retryServiceConfig enables the retries built into gRPC. The server sees
+// their attempt number in grpc-previous-rpc-attempts.
+const retryServiceConfig = `{
+	"methodConfig": [{
+		"name": [{"service": "greeter.Greeter"}],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.1s",
+			"maxBackoff": "1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["INTERNAL", "UNAVAILABLE"]
+		}
+	}]
+}`
+
 func main() {
 	// Parse command line flags
 	name := flag.String("name", defaultName, "Name to greet")
@@ -32,12 +48,15 @@ func main() {
 	simulateError := flag.Bool("error", false, "Simulate server error")
 	delayMs := flag.Int("delay", 0, "Simulate server delay in milliseconds")
 	timeout := flag.Duration("timeout", defaultTimeout, "Request timeout")
+	grpcRetries := flag.Bool("grpc-retries", false, "Also retry within gRPC, using a retry policy in the service config")
 	flag.Parse()
 
 	// Set up a connection to the server
-	conn, err := grpc.Dial(*serverAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if *grpcRetries {
+		opts = append(opts, grpc.WithDefaultServiceConfig(retryServiceConfig))
+	}
+	conn, err := grpc.Dial(*serverAddr, opts...)
 	if err != nil {
 		log.Fatalf("Failed to connect to server: %v", err)
 	}
@@ -68,10 +87,12 @@ func main() {
 		// Create a new context for each attempt
 		attemptCtx, attemptCancel := context.WithTimeout(ctx, *timeout)
 
-		// Make the RPC call
+		// Make the RPC call, collecting the server diagnostics
+		var info diagnostics.CallInfo
 		start := time.Now()
-		resp, err = client.SayHello(attemptCtx, req)
+		resp, err = client.SayHello(attemptCtx, req, info.CallOptions()...)
 		elapsed := time.Since(start)
+		log.Printf("Attempt %d diagnostics: %v", attempt, &info)
 
 		// Clean up the attempt context
 		attemptCancel()
@@ -12,6 +12,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"step-13_retry_timeout/internal/diagnostics"
 	greeterpb "step-13_retry_timeout/internal/greeter"
 )
 
@@ -21,7 +22,7 @@ type server struct {
 }
 
 func (s *server) SayHello(ctx context.Context, req *greeterpb.HelloRequest) (*greeterpb.HelloReply, error) {
-	log.Printf("Received SayHello request for: %s", req.Name)
+	log.Printf("Received SayHello request for: %s (attempt %d)", req.Name, diagnostics.Attempt(ctx))
 
 	// Simulate processing delay if requested
 	if req.DelayMs > 0 {
@@ -66,14 +67,25 @@ func main() {
 	}
 	log.Printf("Starting server on port %s", port)
 
+	// Identify this instance in the response headers, so clients can tell
+	// which server handled a call
+	serverID := os.Getenv("SERVER_ID")
+	if serverID == "" {
+		hostname, _ := os.Hostname()
+		serverID = hostname + ":" + port
+	}
+
 	// Create listener
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	// Create gRPC server
-	srv := grpc.NewServer()
+	// Create gRPC server reporting diagnostics in headers and trailers
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(diagnostics.UnaryServerInterceptor(serverID)),
+		grpc.StreamInterceptor(diagnostics.StreamServerInterceptor(serverID)),
+	)
 	greeterpb.RegisterGreeterServer(srv, &server{port: port})
 
 	log.Printf("Server is ready to accept connections on port %s", port)
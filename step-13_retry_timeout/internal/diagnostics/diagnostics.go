@@ -0,0 +1,143 @@
+// Package diagnostics reports which server handled a call, on which retry
+// attempt and how long it took, in response headers and trailers rather
+// than in the messages. Any RPC gets them without changes to its proto,
+// and they arrive even when the call fails.
+//
+// A client treats a call whose response headers arrived as committed and
+// no longer retries it. Failed unary calls therefore carry everything in
+// the trailers, which keeps them retryable, and only successful ones send
+// headers. Streams, committed by their first message anyway, use trailers
+// throughout.
+package diagnostics
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys set by the server interceptors.
+const (
+	// ServerIDKey identifies the server instance.
+	ServerIDKey = "x-server-id"
+	// AttemptKey is the attempt number of the call as seen by the server,
+	// starting at 1.
+	AttemptKey = "x-attempt"
+	// HandlingTimeKey is the time spent in the handler, as a Go duration
+	// string. Always sent in the trailers.
+	HandlingTimeKey = "x-handling-time"
+)
+
+// previousAttemptsHeader is set by gRPC clients on retried attempts.
+const previousAttemptsHeader = "grpc-previous-rpc-attempts"
+
+// UnaryServerInterceptor adds diagnostics to unary calls served by
+// serverID.
+func UnaryServerInterceptor(serverID string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		if err != nil {
+			grpc.SetTrailer(ctx, metadata.Join(identity(ctx, serverID), handlingTime(start)))
+			return resp, err
+		}
+		grpc.SetHeader(ctx, identity(ctx, serverID))
+		grpc.SetTrailer(ctx, handlingTime(start))
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor adds diagnostics to streaming calls served by
+// serverID.
+func StreamServerInterceptor(serverID string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		ss.SetTrailer(metadata.Join(identity(ss.Context(), serverID), handlingTime(start)))
+		return err
+	}
+}
+
+func identity(ctx context.Context, serverID string) metadata.MD {
+	return metadata.Pairs(
+		ServerIDKey, serverID,
+		AttemptKey, strconv.Itoa(Attempt(ctx)),
+	)
+}
+
+func handlingTime(start time.Time) metadata.MD {
+	return metadata.Pairs(HandlingTimeKey, time.Since(start).String())
+}
+
+// Attempt returns the attempt number of the incoming call in ctx: 1 for
+// the first attempt, and one more for every retry made by the gRPC client.
+func Attempt(ctx context.Context) int {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(previousAttemptsHeader); len(v) > 0 {
+		if n, err := strconv.Atoi(v[0]); err == nil && n >= 0 {
+			return n + 1
+		}
+	}
+	return 1
+}
+
+// CallInfo collects the diagnostics of a call on the client:
+//
+//	var info diagnostics.CallInfo
+//	resp, err := client.SayHello(ctx, req, info.CallOptions()...)
+//	log.Printf("served by %s", info.ServerID())
+//
+// With gRPC retries, they describe the last attempt. The zero value is
+// ready to use; use a new CallInfo for every call.
+type CallInfo struct {
+	Header  metadata.MD
+	Trailer metadata.MD
+}
+
+// CallOptions returns the options that fill in info.
+func (info *CallInfo) CallOptions() []grpc.CallOption {
+	return []grpc.CallOption{grpc.Header(&info.Header), grpc.Trailer(&info.Trailer)}
+}
+
+// ServerID returns the ID of the server that handled the call, or "" if
+// the call never reached one.
+func (info *CallInfo) ServerID() string {
+	return info.get(ServerIDKey)
+}
+
+// Attempt returns the attempt number seen by the server, or 0 if unknown.
+func (info *CallInfo) Attempt() int {
+	n, _ := strconv.Atoi(info.get(AttemptKey))
+	return n
+}
+
+// HandlingTime returns the time the server spent handling the call, or 0
+// if unknown.
+func (info *CallInfo) HandlingTime() time.Duration {
+	d, _ := time.ParseDuration(info.get(HandlingTimeKey))
+	return d
+}
+
+// String summarizes the diagnostics for logs.
+func (info *CallInfo) String() string {
+	if info.ServerID() == "" {
+		return "no server diagnostics"
+	}
+	return fmt.Sprintf("server=%s attempt=%d handling_time=%v", info.ServerID(), info.Attempt(), info.HandlingTime())
+}
+
+// get looks key up in the headers, then in the trailers.
+func (info *CallInfo) get(key string) string {
+	if v := info.Header.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	if v := info.Trailer.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
@@ -9,56 +9,53 @@ import (
 	"syscall"
 	"time"
 
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"step-15_grafana_dashboards/internal/admin"
 	greeterpb "step-15_grafana_dashboards/internal/greeter"
 )
 
-var (
-	requestCounter = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "grpc_client_requests_total",
-			Help: "Total number of gRPC requests",
-		},
-		[]string{"method", "status"},
+func main() {
+	// Create a metrics registry.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	// Create the standard client metrics. The interceptors record
+	// grpc_client_* metrics for every call, labelled with the method and
+	// the real status code.
+	grpcMetrics := grpc_prometheus.NewClientMetrics()
+	grpcMetrics.EnableClientHandlingTimeHistogram(
+		grpc_prometheus.WithHistogramBuckets(prometheus.DefBuckets),
 	)
+	reg.MustRegister(grpcMetrics)
 
-	requestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "grpc_client_request_duration_seconds",
-			Help:    "Duration of gRPC requests in seconds",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"method", "status"},
-	)
-)
-
-func init() {
-	// Register metrics with the global prometheus registry
-	prometheus.MustRegister(requestCounter)
-	prometheus.MustRegister(requestDuration)
-}
-
-func main() {
-	// Start HTTP server for Prometheus metrics
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Println("Starting metrics server on :9093/metrics")
-		log.Fatal(http.ListenAndServe(":9093", nil))
-	}()
+	// Create the admin server (metrics, probes, pprof, channelz).
+	adminServer := admin.New(admin.Config{Addr: ":9093", Gatherer: reg})
 
 	// Set up a connection to the server.
 	conn, err := grpc.Dial("localhost:50051",
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(grpcMetrics.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(grpcMetrics.StreamClientInterceptor()),
 	)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 
+	// Start the admin server for metrics, probes, pprof and channelz.
+	adminServer.AddCheck("greeter-conn", admin.ConnReady(conn))
+	go func() {
+		log.Println("Starting admin server on :9093 (/metrics, /livez, /readyz, /debug/pprof/)")
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Unable to start the admin server: %v", err)
+		}
+	}()
+
 	c := greeterpb.NewGreeterClient(conn)
 
 	// Channel to listen for interrupt signal to terminate.
@@ -87,18 +84,9 @@ func main() {
 			// Make the gRPC call
 			_, err := c.SayHello(context.Background(), &greeterpb.HelloRequest{Name: name})
 
-			// Calculate duration
+			// Calculate duration (metrics are recorded by the interceptors)
 			duration := time.Since(start).Seconds()
 
-			// Record metrics
-			status := "success"
-			if err != nil {
-				status = "error"
-			}
-
-			requestCounter.WithLabelValues("SayHello", status).Inc()
-			requestDuration.WithLabelValues("SayHello", status).Observe(duration)
-
 			if err != nil {
 				log.Printf("Error calling SayHello: %v", err)
 			} else {
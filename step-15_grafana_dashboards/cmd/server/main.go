@@ -5,25 +5,39 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
+	"step-15_grafana_dashboards/internal/admin"
+	"step-15_grafana_dashboards/internal/appmetrics"
 	greeterpb "step-15_grafana_dashboards/internal/greeter"
 )
 
+// Set at build time with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
 type server struct {
 	greeterpb.UnimplementedGreeterServer
+	metrics *appmetrics.Metrics
 }
 
 func (s *server) SayHello(ctx context.Context, in *greeterpb.HelloRequest) (*greeterpb.HelloReply, error) {
 	log.Printf("Received: %v", in.Name)
+	s.metrics.ObserveGreeting(in.Name)
 	if in.Name == "" {
 		return nil, status.Error(codes.InvalidArgument, "Name cannot be empty")
 	}
@@ -49,16 +63,27 @@ func main() {
 	// Register the metrics.
 	reg.MustRegister(grpcMetrics)
 
-	// Create a HTTP server for prometheus.
-	httpServer := &http.Server{
-		Handler: promhttp.HandlerFor(reg, promhttp.HandlerOpts{}),
-		Addr:    ":9092",
-	}
+	// Create the application metrics on the same registry.
+	metrics := appmetrics.New(reg)
+	appmetrics.RegisterBuildInfo(reg, version, commit)
+
+	// Create a health server for the gRPC health service and /readyz.
+	healthServer := health.NewServer()
+
+	// Create the admin server (metrics, probes, pprof, channelz).
+	adminServer := admin.New(admin.Config{
+		Addr:     ":9092",
+		Gatherer: reg,
+		Health:   healthServer,
+		Ready: map[string]admin.Check{
+			"greeter": admin.HealthCheck(healthServer, "greeter.Greeter"),
+		},
+	})
 
-	// Start your http server for prometheus.
+	// Start the admin server.
 	go func() {
-		if err := httpServer.ListenAndServe(); err != nil {
-			log.Fatalf("Unable to start a http server: %v", err)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Unable to start the admin server: %v", err)
 		}
 	}()
 
@@ -69,8 +94,9 @@ func main() {
 	)
 
 	// Register your service.
-	service := &server{}
+	service := &server{metrics: metrics}
 	greeterpb.RegisterGreeterServer(s, service)
+	healthpb.RegisterHealthServer(s, healthServer)
 
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
@@ -84,10 +110,34 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
+	// Report ready once everything is registered.
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("greeter.Greeter", healthpb.HealthCheckResponse_SERVING)
+
+	// On SIGINT/SIGTERM, fail readiness first, then drain in-flight calls.
+	// The admin server stays up while draining, and main waits for it to
+	// shut down once Serve returns.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		log.Println("Shutting down server...")
+		healthServer.Shutdown()
+		s.GracefulStop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		adminServer.Shutdown(ctx)
+	}()
+
 	log.Println("Server started at :50051")
-	log.Println("Metrics available at :9092/metrics")
+	log.Println("Admin endpoints at :9092 (/metrics, /livez, /readyz, /debug/pprof/, channelz)")
 
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
+	<-stopped
 }
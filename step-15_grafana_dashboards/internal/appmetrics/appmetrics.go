@@ -0,0 +1,60 @@
+// Package appmetrics records application-level metrics for the Greeter
+// service, next to the generic RPC metrics of go-grpc-prometheus. Labels
+// derived from user input are reduced to a fixed set of values, so clients
+// cannot create an unbounded number of series.
+package appmetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the Greeter's application metrics.
+type Metrics struct {
+	greetings *prometheus.CounterVec
+}
+
+// New creates the metrics and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		greetings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "greeter_greetings_total",
+			Help: "Greetings requested, by length of the name.",
+		}, []string{"name_length"}),
+	}
+
+	reg.MustRegister(m.greetings)
+
+	// Export every bucket from the start, so rates work before the first
+	// greeting of a kind.
+	for _, bucket := range nameLengthBuckets {
+		m.greetings.WithLabelValues(bucket.label)
+	}
+	return m
+}
+
+var nameLengthBuckets = []struct {
+	max   int
+	label string
+}{
+	{0, "0"},
+	{4, "1-4"},
+	{9, "5-9"},
+	{19, "10-19"},
+	{-1, "20+"},
+}
+
+// nameLengthBucket maps a name to a fixed set of label values.
+func nameLengthBucket(name string) string {
+	n := len([]rune(name))
+	for _, b := range nameLengthBuckets {
+		if b.max < 0 || n <= b.max {
+			return b.label
+		}
+	}
+	return nameLengthBuckets[len(nameLengthBuckets)-1].label
+}
+
+// ObserveGreeting counts a greeting for name.
+func (m *Metrics) ObserveGreeting(name string) {
+	m.greetings.WithLabelValues(nameLengthBucket(name)).Inc()
+}
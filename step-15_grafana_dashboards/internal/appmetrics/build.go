@@ -0,0 +1,43 @@
+package appmetrics
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterBuildInfo registers greeter_build_info, a constant 1 labelled
+// with the build's version and commit. An empty commit is taken from the
+// VCS information Go embeds in the binary, when there is any.
+func RegisterBuildInfo(reg prometheus.Registerer, version, commit string) {
+	if commit == "" {
+		commit = vcsRevision()
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "greeter_build_info",
+		Help: "Build information of the running binary, always 1.",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"commit":    commit,
+			"goversion": runtime.Version(),
+		},
+	}, func() float64 { return 1 }))
+}
+
+func vcsRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return ""
+}